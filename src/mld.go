@@ -6,55 +6,50 @@ import (
 	"os"
 	"path"
 	"smtp"
+	"strings"
 	"time"
 )
 
 var (
-	environ   smtp.Settings
-	rateLimit chan int
+	environ  smtp.Settings
+	schedule = make(chan int, 1)
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("USAGE: %s <config file>\n", path.Base(os.Args[0]))
-		os.Exit(1)
-	}
-	environ, err := smtp.LoadSettings(os.Args[1])
-	if err != nil {
-		if environ == nil {
-			panic(err)
-		} else {
-			environ.Panic(err)
-		}
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		//the socket mode is left to umask: LMTP clients are trusted
+		sock := addr[5:]
+		os.Remove(sock)
+		return net.Listen("unix", sock)
 	}
+	return net.Listen("tcp", addr)
+}
+
+func serve(ln net.Listener, l *smtp.Listener, environ *smtp.Settings) {
+	rateLimit := make(chan int, l.MaxCli)
 	defer func() {
 		err := recover()
 		if err != nil {
 			environ.Panic(err)
 		}
 	}()
-	rateLimit = make(chan int, environ.MaxCli)
-	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(environ.Bind), Port: environ.Port})
-	if err != nil {
-		panic(err)
-	}
-	ln.SetDeadline(time.Now().Add(1 * time.Minute))
-	environ.Log(environ.Dump())
-	fmt.Println(environ.Dump())
 	for {
-		go smtp.SendMails(environ.Spool+"/outbound", environ)
 		conn, err := ln.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Temporary() {
-				if !opErr.Timeout() {
-					environ.Log("RUNERR: " + opErr.Error())
-				}
-				ln.SetDeadline(time.Now().Add(1 * time.Minute))
+				environ.Log("RUNERR: " + opErr.Error())
+				time.Sleep(time.Second)
 				continue
 			} else {
 				panic(err)
 			}
 		}
+		if environ.Denied(conn.RemoteAddr()) {
+			environ.Log("Denied: " + conn.RemoteAddr().String())
+			conn.Write([]byte("554 Access denied\r\n"))
+			conn.Close()
+			continue
+		}
 		select {
 		case rateLimit <- 1:
 		default:
@@ -63,22 +58,37 @@ func main() {
 			conn.Close()
 			continue
 		}
+		if msg := environ.Admit(conn.RemoteAddr()); msg != "" {
+			conn.Write([]byte(msg + "\r\n"))
+			conn.Close()
+			<-rateLimit
+			continue
+		}
 		environ.Debug("Connected: " + conn.RemoteAddr().String())
 		go func(environ *smtp.Settings) {
-			s, err := smtp.NewSvrSession(conn, environ)
-			if err != nil {
-				environ.Panic(err)
-			}
 			defer func() {
 				environ.Debug("Disconnected: " + conn.RemoteAddr().String())
 				conn.Close()
+				environ.Release(conn.RemoteAddr())
 				<-rateLimit
-				s.Reset(smtp.PROC_FLUSH)
+				select {
+				case schedule <- 1:
+				default:
+				}
 				err := recover()
 				if err != nil {
-					environ.Panic(err)
+					environ.Logf("RUNERR: %s: %v", conn.RemoteAddr(), err)
 				}
 			}()
+			s, err := smtp.NewSvrSession(conn, environ, l)
+			if s != nil {
+				defer s.Reset(smtp.PROC_FLUSH)
+			}
+			if err != nil {
+				//e.g. a failed TLS handshake (smtps) or a client gone
+				environ.Logf("%s: ERROR! %s", conn.RemoteAddr(), err.Error())
+				return
+			}
 			err = s.Serve()
 			if err != nil {
 				environ.Logf("%s: ERROR! %s", s.CliAddr(), err.Error())
@@ -86,3 +96,41 @@ func main() {
 		}(environ)
 	}
 }
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Printf("USAGE: %s <config file>\n", path.Base(os.Args[0]))
+		os.Exit(1)
+	}
+	environ, err := smtp.LoadSettings(os.Args[1])
+	if err != nil {
+		if environ == nil {
+			panic(err)
+		} else {
+			environ.Panic(err)
+		}
+	}
+	defer func() {
+		err := recover()
+		if err != nil {
+			environ.Panic(err)
+		}
+	}()
+	for i := range environ.Listeners {
+		l := &environ.Listeners[i]
+		ln, err := listen(l.Address)
+		if err != nil {
+			panic(err)
+		}
+		go serve(ln, l, environ)
+	}
+	environ.Log(environ.Dump())
+	fmt.Println(environ.Dump())
+	for {
+		smtp.SendMails(environ.Spool+"/outbound", environ)
+		select {
+		case <-schedule:
+		case <-time.After(1 * time.Minute):
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipMatcher is a compiled access list of IPv4/IPv6 networks.
+type ipMatcher []*net.IPNet
+
+func (m ipMatcher) match(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range m {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileACL builds a matcher from entries which are IP addresses, CIDR
+// blocks (e.g. "10.0.0.0/8", "2001:db8::/32") or "@name" references to
+// Settings.AccessLists.
+func (s *Settings) compileACL(entries []string, seen map[string]bool) (ipMatcher, error) {
+	var m ipMatcher
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if strings.HasPrefix(e, "@") {
+			name := e[1:]
+			group, ok := s.AccessLists[name]
+			if !ok {
+				return nil, fmt.Errorf("access list %q not defined", name)
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("access list %q includes itself", name)
+			}
+			seen[name] = true
+			sub, err := s.compileACL(group, seen)
+			delete(seen, name)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, sub...)
+			continue
+		}
+		if strings.Index(e, "/") < 0 {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", e)
+			}
+			if ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, n)
+	}
+	return m, nil
+}
+
+func (s *Settings) compileACLs() (err error) {
+	s.relayACL, err = s.compileACL(s.OpenRelay, map[string]bool{})
+	if err == nil {
+		s.allowACL, err = s.compileACL(s.Allow, map[string]bool{})
+	}
+	if err == nil {
+		s.denyACL, err = s.compileACL(s.Deny, map[string]bool{})
+	}
+	return
+}
+
+// Denied tells whether connections from addr should be refused, i.e. the
+// address is on the Deny list and not on the Allow list.
+func (s *Settings) Denied(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return s.denyACL.match(ip) && !s.allowACL.match(ip)
+}
@@ -0,0 +1,252 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC chain validation results (RFC8617, 4.4)
+const (
+	ARC_NONE = "none"
+	ARC_PASS = "pass"
+	ARC_FAIL = "fail"
+)
+
+const maxARCSets = 50 //RFC8617, 4.2.1
+
+type arcSet struct {
+	aar, ams, as header
+	present      int //number of the above found
+}
+
+type arcResult struct {
+	cv     string
+	reason string
+	sets   []arcSet //sets[0] is instance 1
+	closed bool     //the chain is marked failed, no sets may be added
+}
+
+func (r arcResult) String() string {
+	if r.reason != "" {
+		return "arc=" + r.cv + " (" + r.reason + ")"
+	}
+	return "arc=" + r.cv
+}
+
+// arcInstance returns the instance (i=) of an ARC header field.
+func arcInstance(h header) (int, error) {
+	v := h.unfolded()
+	if strings.EqualFold(strings.TrimSpace(h.name), "ARC-Authentication-Results") {
+		v = strings.SplitN(v, ";", 2)[0]
+	}
+	tags, err := parseTags(v)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(tags["i"])
+	if err != nil || i < 1 || i > maxARCSets {
+		return 0, errors.New("invalid instance")
+	}
+	return i, nil
+}
+
+// arcChain validates the ARC chain of m (RFC8617, 5.2).
+func (s *Settings) arcChain(m *message) *arcResult {
+	r := &arcResult{cv: ARC_FAIL}
+	sets := make(map[int]*arcSet)
+	max := 0
+	for _, h := range m.hdrs {
+		name := strings.ToLower(strings.TrimSpace(h.name))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		i, err := arcInstance(h)
+		if err != nil {
+			r.reason = name + ": " + err.Error()
+			return r
+		}
+		set := sets[i]
+		if set == nil {
+			set = &arcSet{}
+			sets[i] = set
+		}
+		switch name {
+		case "arc-seal":
+			set.as = h
+		case "arc-message-signature":
+			set.ams = h
+		default:
+			set.aar = h
+		}
+		set.present++
+		if i > max {
+			max = i
+		}
+	}
+	if max == 0 {
+		r.cv = ARC_NONE
+		return r
+	}
+	for i := 1; i <= max; i++ {
+		if sets[i] == nil || sets[i].present != 3 || sets[i].as.raw == "" ||
+			sets[i].ams.raw == "" || sets[i].aar.raw == "" {
+			r.reason = fmt.Sprintf("invalid set i=%d", i)
+			return r
+		}
+		r.sets = append(r.sets, *sets[i])
+	}
+	for i, set := range r.sets {
+		tags, err := parseTags(set.as.unfolded())
+		if err != nil {
+			r.reason = err.Error()
+			return r
+		}
+		cv := tags["cv"]
+		if cv == ARC_FAIL && i == max-1 {
+			r.closed = true
+		}
+		if i == 0 && cv != ARC_NONE || i > 0 && cv != ARC_PASS {
+			r.reason = fmt.Sprintf("i=%d cv=%s", i+1, cv)
+			return r
+		}
+	}
+	if err := s.verifyAMS(m, r.sets[max-1].ams); err != nil {
+		r.reason = fmt.Sprintf("i=%d AMS %v", max, err)
+		return r
+	}
+	for i := max; i > 0; i-- {
+		if err := s.verifyAS(r.sets[:i]); err != nil {
+			r.reason = fmt.Sprintf("i=%d AS %v", i, err)
+			return r
+		}
+	}
+	r.cv = ARC_PASS
+	return r
+}
+
+// verifyAMS verifies an ARC-Message-Signature, much like a DKIM-Signature.
+func (s *Settings) verifyAMS(m *message, ams header) error {
+	tags, err := parseTags(ams.unfolded())
+	if err != nil {
+		return err
+	}
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			return errors.New("missing tag " + t)
+		}
+	}
+	fields := strings.Split(tags["h"], ":")
+	for _, f := range fields {
+		if strings.EqualFold(strings.TrimSpace(f), "arc-seal") {
+			return errors.New("signs ARC-Seal")
+		}
+	}
+	hrelaxed, brelaxed, err := dkimCanon(tags["c"])
+	if err != nil {
+		return err
+	}
+	bh := sha256.Sum256(canonBody(m.body, brelaxed))
+	if base64.StdEncoding.EncodeToString(bh[:]) != reFWS.ReplaceAllString(tags["bh"], "") {
+		return errors.New("body hash mismatch")
+	}
+	sig, err := base64.StdEncoding.DecodeString(reFWS.ReplaceAllString(tags["b"], ""))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	key, err := s.dkimKey(tags["s"], strings.ToLower(tags["d"]))
+	if err != nil {
+		return err
+	}
+	bare := header{ams.name, ams.name + ":" + reTagB.ReplaceAllString(ams.value(), "$1$2")}
+	data := dkimHeaders(m, fields, hrelaxed) + strings.TrimSuffix(canonHeader(bare, hrelaxed), "\r\n")
+	if !checkSig(key, strings.ToLower(tags["a"]), data, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// arcSealData returns the canonicalized data signed by the last ARC-Seal of
+// sets (RFC8617, 5.1.1).
+func arcSealData(sets []arcSet) string {
+	data := ""
+	for i, set := range sets {
+		data += canonHeader(set.aar, true) + canonHeader(set.ams, true)
+		if i < len(sets)-1 {
+			data += canonHeader(set.as, true)
+		} else {
+			bare := header{set.as.name, set.as.name + ":" + reTagB.ReplaceAllString(set.as.value(), "$1$2")}
+			data += strings.TrimSuffix(canonHeader(bare, true), "\r\n")
+		}
+	}
+	return data
+}
+
+// verifyAS verifies the ARC-Seal of the last of sets.
+func (s *Settings) verifyAS(sets []arcSet) error {
+	tags, err := parseTags(sets[len(sets)-1].as.unfolded())
+	if err != nil {
+		return err
+	}
+	for _, t := range []string{"a", "b", "cv", "d", "s"} {
+		if tags[t] == "" {
+			return errors.New("missing tag " + t)
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(reFWS.ReplaceAllString(tags["b"], ""))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+	key, err := s.dkimKey(tags["s"], strings.ToLower(tags["d"]))
+	if err != nil {
+		return err
+	}
+	if !checkSig(key, strings.ToLower(tags["a"]), arcSealData(sets), sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// arcSeal adds an ARC set to m, sealed as the first of domains with a key,
+// carrying authRes (our Authentication-Results) and the validation result of
+// the ARC chain the message came with.
+func (s *Settings) arcSeal(m *message, chain *arcResult, authRes string, domains ...string) error {
+	d, ds := s.pickSigner(domains...)
+	if ds == nil || chain.closed || len(chain.sets) >= maxARCSets {
+		return nil
+	}
+	switch len(m.getAll("ARC-Seal")) + len(m.getAll("ARC-Message-Signature")) + len(m.getAll("ARC-Authentication-Results")) {
+	case 0:
+		chain = &arcResult{cv: ARC_NONE} //wrapped, m is a new message
+	case 3 * len(chain.sets):
+	default:
+		return nil //arcChain gave up on a broken chain, not to be sealed upon
+	}
+	i := len(chain.sets) + 1
+	now := time.Now().Unix()
+	set := arcSet{present: 3}
+	set.aar = header{"ARC-Authentication-Results", fmt.Sprintf("ARC-Authentication-Results: i=%d; %s", i, authRes)}
+	fields := signedFields(m, "dkim-signature")
+	bh := sha256.Sum256(canonBody(m.body, true))
+	set.ams = header{"ARC-Message-Signature", fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		i, ds.algo, d, ds.selector, now, strings.Join(fields, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))}
+	b, err := ds.sign(dkimHeaders(m, fields, true) + strings.TrimSuffix(canonHeader(set.ams, true), "\r\n"))
+	if err != nil {
+		return err
+	}
+	set.ams.raw += b
+	set.as = header{"ARC-Seal", fmt.Sprintf("ARC-Seal: i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tt=%d; b=",
+		i, ds.algo, chain.cv, d, ds.selector, now)}
+	b, err = ds.sign(arcSealData(append(chain.sets[:len(chain.sets):len(chain.sets)], set)))
+	if err != nil {
+		return err
+	}
+	set.as.raw += b
+	m.hdrs = append([]header{set.as, set.ams, set.aar}, m.hdrs...)
+	return nil
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestARCSealValidate(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := dkimSettings(t, key)
+	m := parseMessage([]byte(crlf("From: joe@example.net\nTo: list@example.com\nSubject: hi\n\nbody\n")))
+	chain := s.arcChain(m)
+	if chain.cv != ARC_NONE {
+		t.Fatalf("unsealed message: %s", chain)
+	}
+	//sealed by two hops, the second one modifying the message first
+	if err = s.arcSeal(m, chain, "mx.example.com; spf=pass smtp.mailfrom=example.net", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	m = parseMessage(m.bytes())
+	if chain = s.arcChain(m); chain.cv != ARC_PASS || len(chain.sets) != 1 {
+		t.Fatalf("one set: %s", chain)
+	}
+	m.change("Subject", 1, "[list] hi")
+	m.body = append(m.body, "footer\r\n"...)
+	if err = s.arcSeal(m, chain, "mx.example.com; arc=pass", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	sealed := string(m.bytes())
+	if chain = s.arcChain(parseMessage([]byte(sealed))); chain.cv != ARC_PASS || len(chain.sets) != 2 {
+		t.Fatalf("two sets: %s\n%s", chain, sealed)
+	}
+	for _, c := range []struct {
+		change func(string) string
+		reason string
+	}{
+		{func(m string) string { return m + "more\r\n" }, "i=2 AMS body hash mismatch"},
+		{func(m string) string { return strings.Replace(m, "[list] hi", "[list] hello", 1) }, "i=2 AMS signature verification failed"},
+		{func(m string) string {
+			return strings.Replace(m, "i=1; mx.example.com; spf=pass", "i=1; mx.example.com; spf=fail", 1)
+		}, "i=2 AS signature verification failed"},
+		{func(m string) string { return strings.Replace(m, "cv=pass", "cv=none", 1) }, "i=2 cv=none"},
+		{func(m string) string { return strings.Replace(m, "ARC-Seal: i=1", "ARC-Seal: i=3", 1) }, "invalid set i=1"},
+	} {
+		r := s.arcChain(parseMessage([]byte(c.change(sealed))))
+		if r.cv != ARC_FAIL || r.reason != c.reason {
+			t.Errorf("%s, want fail (%s)", r, c.reason)
+		}
+	}
+	//a broken chain is sealed with cv=fail, which closes it
+	broken := parseMessage([]byte(sealed + "more\r\n"))
+	chain = s.arcChain(broken)
+	if err = s.arcSeal(broken, chain, "mx.example.com; arc=fail", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(broken.get("ARC-Seal"), "i=3; a=ed25519-sha256; cv=fail;") {
+		t.Fatalf("broken chain sealed with %s", broken.get("ARC-Seal"))
+	}
+	chain = s.arcChain(parseMessage(broken.bytes()))
+	if chain.cv != ARC_FAIL || !chain.closed {
+		t.Errorf("closed chain: %s, closed %v", chain, chain.closed)
+	}
+	n := len(broken.hdrs)
+	if err = s.arcSeal(broken, chain, "mx.example.com; arc=fail", "example.com"); err != nil || len(broken.hdrs) != n {
+		t.Errorf("closed chain sealed again: %v", err)
+	}
+}
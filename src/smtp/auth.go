@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// dummyHash is checked for unknown users, so that they take as long to be
+// refused as known users with a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func (s *Settings) compileUsers() error {
+	for user, hash := range s.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("user %s: password is not a bcrypt hash", user)
+		}
+	}
+	return nil
+}
+
+// authenticate checks AUTH credentials against Settings.Users, where the
+// passwords are stored as bcrypt hashes.
+func (s *Settings) authenticate(user, pass string) bool {
+	stored, ok := s.Users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil
+}
+
+func (s *svrSession) authResult(user, pass string) string {
+	if s.authenticate(user, pass) {
+		s.auth = user
+		s.Logf("%s: AUTH %s", s.CliAddr(), user)
+		return "235 Authentication successful"
+	}
+	s.p_errs++
+	s.Logf("%s: AUTH failed for %s", s.CliAddr(), user)
+	return "535 Authentication credentials invalid"
+}
+
+func (s *svrSession) authPlain(resp string) string {
+	if resp == "*" {
+		return "501 Authentication cancelled"
+	}
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		s.p_errs++
+		return "501 Invalid base64 data"
+	}
+	p := bytes.Split(dec, []byte{0})
+	if len(p) != 3 {
+		s.p_errs++
+		return "501 Invalid PLAIN response"
+	}
+	return s.authResult(string(p[1]), string(p[2]))
+}
+
+func (s *svrSession) authLogin(user string) func(string) string {
+	return func(resp string) string {
+		if resp == "*" {
+			return "501 Authentication cancelled"
+		}
+		dec, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			s.p_errs++
+			return "501 Invalid base64 data"
+		}
+		if user == "" {
+			s.authCont = s.authLogin(string(dec))
+			return "334 UGFzc3dvcmQ6" //"Password:"
+		}
+		return s.authResult(user, string(dec))
+	}
+}
+
+// authCmd handles AUTH (RFC4954) with the PLAIN and LOGIN mechanisms.
+func (s *svrSession) authCmd(param string) string {
+	if len(s.Users) == 0 || s.lsnr.Mode == "lmtp" {
+		s.p_errs++
+		return "502 Command not implemented"
+	}
+	if s.state != 2 || s.auth != "" {
+		s.p_errs++
+		return "503 Bad sequence of commands"
+	}
+	if !s.tls && !s.lsnr.PlainAuth {
+		return "538 Encryption required for requested authentication mechanism"
+	}
+	p := strings.Fields(param)
+	if len(p) == 0 {
+		s.p_errs++
+		return "501 Syntax error"
+	}
+	switch strings.ToUpper(p[0]) {
+	case "PLAIN":
+		if len(p) > 1 {
+			return s.authPlain(p[1])
+		}
+		s.authCont = s.authPlain
+		return "334 "
+	case "LOGIN":
+		if len(p) > 1 {
+			return s.authLogin("")(p[1])
+		}
+		s.authCont = s.authLogin("")
+		return "334 VXNlcm5hbWU6" //"Username:"
+	}
+	return "504 Unrecognized authentication type"
+}
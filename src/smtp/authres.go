@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// authServID returns the authserv-id of an Authentication-Results header.
+func authServID(h header) string {
+	v := h.unfolded()
+	if semi := strings.Index(v, ";"); semi >= 0 {
+		v = v[:semi]
+	}
+	if f := strings.Fields(v); len(f) > 0 {
+		return strings.ToLower(f[0])
+	}
+	return ""
+}
+
+// authResults records the SPF, DKIM, DMARC and ARC results of the message in an
+// Authentication-Results header (RFC8601), after removing any such headers
+// forged with our authserv-id (RFC8601, 5).
+func (s *svrSession) authResults(m *message) {
+	id := s.localDomain()
+	m.remove("Authentication-Results", func(h header) bool {
+		return authServID(h) == strings.ToLower(id)
+	})
+	res := []string{id}
+	if s.spf != "" {
+		if s.spfID == "helo" {
+			res = append(res, "spf="+s.spf+" smtp.helo="+s.helo)
+		} else {
+			res = append(res, "spf="+s.spf+" smtp.mailfrom="+s.sender)
+		}
+	}
+	if len(s.dkim) == 0 {
+		res = append(res, "dkim=none")
+	}
+	for _, r := range s.dkim {
+		res = append(res, r.String())
+	}
+	if s.dmarc != nil {
+		res = append(res, s.dmarc.String())
+	}
+	if s.arc != nil {
+		res = append(res, s.arc.String())
+	}
+	s.authRes = strings.Join(res, ";\r\n\t")
+	m.prepend("Authentication-Results: " + s.authRes)
+}
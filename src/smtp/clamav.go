@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamav configures virus scanning of received messages by clamd.  It is
+// enabled by setting Address.
+type clamav struct {
+	Address  string //"host:port" or "unix:/path" of clamd
+	Timeout  int    //seconds allowed for a scan, defaults to 30
+	Infected string //reject (default) or hold (quarantine) infected messages
+	FailOpen bool   //accept mail if clamd fails, instead of tempfailing it
+}
+
+const clamChunk = 65536
+
+func (s *Settings) compileClamAV() error {
+	if s.ClamAV.Address == "" {
+		return nil
+	}
+	if s.ClamAV.Timeout <= 0 {
+		s.ClamAV.Timeout = 30
+	}
+	switch s.ClamAV.Infected {
+	case "":
+		s.ClamAV.Infected = ACT_REJECT
+	case ACT_REJECT, ACT_HOLD:
+	default:
+		return fmt.Errorf("ClamAV: invalid Infected action %q", s.ClamAV.Infected)
+	}
+	return nil
+}
+
+// scan streams data to clamd (INSTREAM command) and returns the name of the
+// virus found, or "".
+func (c clamav) scan(data []byte) (string, error) {
+	network, address := "tcp", c.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", address[5:]
+	}
+	timeout := time.Duration(c.Timeout) * time.Second
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := len(data)
+		if n > clamChunk {
+			n = clamChunk
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err = conn.Write(append(size, data[:n]...)); err != nil {
+			return "", err
+		}
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return "", err
+	}
+	var reply []byte
+	buf := make([]byte, 256)
+	for !bytes.Contains(reply, []byte{0}) {
+		n, err := conn.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if err != nil {
+			if len(reply) > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	r := strings.TrimSpace(strings.SplitN(string(reply), "\x00", 2)[0])
+	r = strings.TrimPrefix(r, "stream: ")
+	switch {
+	case r == "OK":
+		return "", nil
+	case strings.HasSuffix(r, " FOUND"):
+		return strings.TrimSuffix(r, " FOUND"), nil
+	}
+	return "", errors.New(r)
+}
+
+// virusScan has the message scanned by clamd, returning the reply if it is
+// to be refused, or "".
+func (s *svrSession) virusScan(m *message) string {
+	virus, err := s.ClamAV.scan(m.bytes())
+	if err != nil {
+		s.Logf("RUNERR: clamd %s: %s", s.ClamAV.Address, err.Error())
+		if s.ClamAV.FailOpen {
+			return ""
+		}
+		return "451 4.7.1 Virus scanner unavailable - try again later"
+	}
+	if virus == "" {
+		return ""
+	}
+	s.Logf("%s: VIRUS %s found in message from <%s>", s.CliAddr(), virus, s.sender)
+	if s.ClamAV.Infected == ACT_HOLD {
+		s.quarantine = "virus " + virus
+		return ""
+	}
+	return "554 5.7.1 Message infected with " + virus
+}
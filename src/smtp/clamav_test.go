@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd accepts one INSTREAM scan and answers it with reply(data), or
+// not at all if reply returns "".
+func fakeClamd(t *testing.T, reply func([]byte) string) (string, chan []byte) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []byte, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cmd := make([]byte, len("zINSTREAM\x00"))
+		if _, err = io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+			got <- nil
+			return
+		}
+		var data []byte
+		size := make([]byte, 4)
+		for {
+			if _, err = io.ReadFull(conn, size); err != nil {
+				got <- nil
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err = io.ReadFull(conn, chunk); err != nil {
+				got <- nil
+				return
+			}
+			data = append(data, chunk...)
+		}
+		got <- data
+		if r := reply(data); r != "" {
+			conn.Write([]byte(r + "\x00"))
+		} else {
+			io.Copy(ioutil.Discard, conn) //until the client gives up
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestClamAVScan(t *testing.T) {
+	eicar := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+	big := bytes.Repeat([]byte("0123456789abcdef"), clamChunk/8) //2 chunks
+	for _, c := range []struct {
+		name  string
+		data  []byte
+		reply func([]byte) string
+		virus string
+		err   string
+	}{
+		{"ok", big, func([]byte) string { return "stream: OK" }, "", ""},
+		{"found", eicar, func(d []byte) string {
+			if bytes.Contains(d, []byte("EICAR")) {
+				return "stream: Eicar-Signature FOUND"
+			}
+			return "stream: OK"
+		}, "Eicar-Signature", ""},
+		{"error", big, func([]byte) string { return "INSTREAM size limit exceeded. ERROR" }, "", "size limit exceeded"},
+		{"timeout", eicar, func([]byte) string { return "" }, "", "timeout"},
+	} {
+		addr, got := fakeClamd(t, c.reply)
+		virus, err := clamav{Address: addr, Timeout: 1}.scan(c.data)
+		if data := <-got; !bytes.Equal(data, c.data) {
+			t.Errorf("%s: clamd received %d bytes, want %d", c.name, len(data), len(c.data))
+		}
+		if virus != c.virus {
+			t.Errorf("%s: virus %q, want %q", c.name, virus, c.virus)
+		}
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log4g"
@@ -12,6 +13,7 @@ import (
 
 type cliSession struct {
 	server string
+	lmtp   bool
 	reader *bufio.Reader
 	lg     log4g.Logger
 	net.Conn
@@ -58,16 +60,54 @@ func (s *cliSession) act(cmd string, expect string) (error, []string) {
 	return nil, reply
 }
 
-func NewCliSession(server string, env *envelope) (*cliSession, error) {
-	if strings.Index(server, ":") < 0 {
-		server = server + ":25"
+func dial(server string, r Resolver) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return net.Dial("tcp", server)
+	}
+	ips, err := r.LookupIP(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// NewCliSession connects to an SMTP server, or an LMTP server (RFC2033) if lmtp
+// is set.  LMTP servers may also be given as "unix:/path/to/socket".
+func NewCliSession(server string, lmtp bool, env *envelope) (*cliSession, error) {
+	var conn net.Conn
+	var err error
+	if strings.HasPrefix(server, "unix:") {
+		conn, err = net.Dial("unix", server[5:])
+	} else {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			port := "25"
+			if lmtp {
+				port = "24"
+			}
+			server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+		}
+		conn, err = dial(server, env.dns)
 	}
-	conn, err := net.Dial("tcp", server)
 	if err != nil {
 		return nil, err
 	}
 	cs := &cliSession{
 		server,
+		lmtp,
 		bufio.NewReader(conn),
 		env.SysLogger,
 		conn,
@@ -78,6 +118,16 @@ func NewCliSession(server string, env *envelope) (*cliSession, error) {
 	}
 	p := strings.Split(env.Origin, "@")
 	origin := p[len(p)-1]
+	if origin == "" || strings.HasPrefix(origin, "[") {
+		origin = "[127.0.0.1]"
+		if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			origin = addrLiteral(la.IP)
+		}
+	}
+	if lmtp {
+		err, _ = cs.act("LHLO "+origin, "2")
+		return cs, err
+	}
 	err, _ = cs.act("EHLO "+origin, "2")
 	if err != nil {
 		err, _ = cs.act("HELO "+origin, "")
@@ -0,0 +1,228 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"text/template"
+)
+
+// decoration is the data list header and footer templates are executed
+// with, e.g. "Posted to {{.Name}} by {{.Sender}}".
+type decoration struct {
+	List    string //list address
+	Name    string //list name
+	Sender  string //envelope sender
+	From    string //author (From header, decoded)
+	Subject string //decoded Subject, without the tag
+}
+
+func compileTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Option("missingkey=zero").Parse(text)
+}
+
+func render(t *template.Template, d decoration) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	text := strings.Replace(strings.TrimRight(buf.String(), "\r\n"), "\r\n", "\n", -1)
+	return strings.Replace(text, "\n", "\r\n", -1), nil
+}
+
+func decodeHeader(v string) string {
+	if d, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return d
+	}
+	return v
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// tagSubject prefixes the Subject of m with tag, unless the tag is found
+// in it already (e.g. in replies: "Re: [tag] ...").  The Subject may contain
+// RFC2047 encoded words, which the tag must be separated from by a space.
+func tagSubject(m *message, tag string) {
+	subj := ""
+	if hs := m.getAll("Subject"); len(hs) > 0 {
+		subj = strings.TrimSpace(hs[0].value())
+	}
+	if strings.Contains(strings.ToLower(decodeHeader(subj)), strings.ToLower(tag)) {
+		return
+	}
+	if !isASCII(tag) {
+		tag = mime.QEncoding.Encode("utf-8", tag)
+	}
+	if subj == "" {
+		m.change("Subject", 1, tag)
+	} else {
+		m.change("Subject", 1, tag+" "+subj)
+	}
+}
+
+// signed reports whether the message is signed or encrypted (S/MIME, PGP),
+// which decorating the body would break.
+func (p *mimePart) signed() bool {
+	switch p.ctype {
+	case "multipart/signed", "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return p.parts == nil && bytes.Contains(p.body, []byte("-----BEGIN PGP "))
+}
+
+// textPart creates an inline text/plain part.
+func textPart(text string) *mimePart {
+	m := &message{}
+	m.insert("Content-Type: text/plain; charset=utf-8")
+	if isASCII(text) {
+		m.insert("Content-Transfer-Encoding: 7bit")
+		m.body = []byte(text)
+	} else {
+		m.insert("Content-Transfer-Encoding: quoted-printable")
+		m.body = encodeQP([]byte(text))
+	}
+	m.insert("Content-Disposition: inline")
+	return &mimePart{message: m, ctype: "text/plain", params: map[string]string{"charset": "utf-8"}}
+}
+
+func encodeQP(data []byte) []byte {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// appendable reports whether text can be added to the body of p, a plain
+// text part in a compatible charset.
+func (p *mimePart) appendable(text string) bool {
+	if p.parts != nil || p.ctype != "text/plain" || p.attachment() {
+		return false
+	}
+	switch strings.ToLower(p.params["charset"]) {
+	case "", "us-ascii", "utf-8":
+		return true
+	}
+	return isASCII(text)
+}
+
+// addText puts top above and bottom below the text of p, keeping its
+// transfer encoding (7bit bodies become 8bit for non-ASCII text).
+func (p *mimePart) addText(top, bottom string) {
+	//a copy: the body may share its array with the message other variants are parsed from
+	text := append([]byte(nil), p.decoded()...)
+	if top != "" {
+		text = append([]byte(top+"\r\n\r\n"), text...)
+	}
+	if bottom != "" {
+		if len(text) > 0 && !bytes.HasSuffix(text, crlfBytes) {
+			text = append(text, crlfBytes...)
+		}
+		text = append(text, []byte(bottom+"\r\n")...)
+	}
+	switch cte := strings.ToLower(p.get("Content-Transfer-Encoding")); cte {
+	case "base64":
+		enc := base64.StdEncoding.EncodeToString(text)
+		var buf bytes.Buffer
+		for len(enc) > 76 {
+			buf.WriteString(enc[:76] + "\r\n")
+			enc = enc[76:]
+		}
+		buf.WriteString(enc + "\r\n")
+		p.body = buf.Bytes()
+	case "quoted-printable":
+		p.body = encodeQP(text)
+	default:
+		if !isASCII(top+bottom) && (cte == "" || cte == "7bit") {
+			p.remove("Content-Transfer-Encoding", func(header) bool { return true })
+			p.insert("Content-Transfer-Encoding: 8bit")
+			if p.params["charset"] == "" {
+				p.remove("Content-Type", func(header) bool { return true })
+				p.insert("Content-Type: text/plain; charset=utf-8")
+				p.params = map[string]string{"charset": "utf-8"}
+			}
+		}
+		p.body = text
+	}
+}
+
+// wrapMixed turns p into a multipart/mixed message whose only part is the
+// original content.
+func (p *mimePart) wrapMixed() {
+	inner := &message{body: p.body}
+	hdrs := p.hdrs[:0]
+	for _, h := range p.hdrs {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(h.name)), "content-") {
+			inner.hdrs = append(inner.hdrs, h)
+		} else {
+			hdrs = append(hdrs, h)
+		}
+	}
+	p.hdrs = hdrs
+	c := &mimePart{inner, p.ctype, p.params, p.parts, p.preamble, p.epilogue}
+	b := "=_" + newMsgId()
+	if p.get("MIME-Version") == "" {
+		p.insert("MIME-Version: 1.0")
+	}
+	p.insert(`Content-Type: multipart/mixed; boundary="` + b + `"`)
+	p.ctype, p.params, p.parts = "multipart/mixed", map[string]string{"boundary": b}, []*mimePart{c}
+	p.preamble, p.epilogue = nil, crlfBytes
+}
+
+// decorate adds the Subject tag, header and footer of list to m.
+func (s *svrSession) decorate(m *message, list string, p listPolicy) error {
+	d := decoration{
+		List:    list,
+		Name:    p.name(list),
+		Sender:  s.sender,
+		From:    decodeHeader(m.get("From")),
+		Subject: decodeHeader(m.get("Subject")),
+	}
+	if p.SubjectTag != "" {
+		d.Subject = strings.TrimSpace(strings.Replace(d.Subject, p.SubjectTag, "", 1))
+		tagSubject(m, p.SubjectTag)
+	}
+	top, err := render(p.header, d)
+	if err != nil {
+		return err
+	}
+	bottom, err := render(p.footer, d)
+	if err != nil || top == "" && bottom == "" {
+		return err
+	}
+	mp := parseMIME(m)
+	if mp.signed() && !p.DecorateSigned {
+		s.Debugf("%s>   %s: signed message not decorated", s.CliAddr(), list)
+		return nil
+	}
+	switch {
+	case mp.appendable(top + bottom):
+		mp.addText(top, bottom)
+		return nil
+	case mp.ctype != "multipart/mixed":
+		mp.wrapMixed()
+	}
+	if top != "" {
+		mp.parts = append([]*mimePart{textPart(top)}, mp.parts...)
+	}
+	if bottom != "" {
+		mp.parts = append(mp.parts, textPart(bottom))
+	}
+	mp.flatten()
+	return nil
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"bytes"
+	"log4g"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testSession returns a session of a local client, whose logger must not be
+// written to (Debugf is fine, it is not verbose).
+func testSession(t *testing.T, s *Settings) *svrSession {
+	c, _ := net.Pipe()
+	t.Cleanup(func() { c.Close() })
+	if s.SysLogger == nil {
+		s.SysLogger = &log4g.SysLogger{}
+	}
+	return &svrSession{conn: c, sender: "s@example.org", Settings: s}
+}
+
+func testPolicy(t *testing.T, p listPolicy) listPolicy {
+	var err error
+	if p.header, err = compileTemplate("header", p.Header); err != nil {
+		t.Fatal(err)
+	}
+	if p.footer, err = compileTemplate("footer", p.Footer); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDecorate(t *testing.T) {
+	plain := "From: Joe <joe@example.org>\r\nSubject: hello\r\n\r\nbody\r\n"
+	mixed := "From: joe@example.org\r\nSubject: hi\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\ntext\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>text</p>\r\n--b--\r\n"
+	signed := "From: joe@example.org\r\nSubject: hi\r\n\r\n-----BEGIN PGP SIGNED MESSAGE-----\r\nbody\r\n"
+	cases := []struct {
+		msg    string
+		policy listPolicy
+		want   []string //substrings of the result
+		ctype  string   //Content-Type of the result
+		absent string   //not in the result
+	}{
+		{plain, listPolicy{SubjectTag: "[list]"}, []string{"Subject: [list] hello\r\n", "\r\n\r\nbody\r\n"}, "", ""},
+		{plain, listPolicy{Footer: "-- \r\n{{.Name}}: {{.From}}"}, []string{"\r\n\r\nbody\r\n-- \r\nlist: Joe <joe@example.org>\r\n"}, "", ""},
+		{plain, listPolicy{Header: "posted by {{.Sender}}"}, []string{"\r\n\r\nposted by s@example.org\r\n\r\nbody\r\n"}, "", ""},
+		{plain, listPolicy{Footer: "grüße"}, []string{"Content-Transfer-Encoding: 8bit", "body\r\ngrüße\r\n"}, "text/plain; charset=utf-8", ""},
+		{mixed, listPolicy{Footer: "footer"}, []string{"--b--", "\r\n\r\nfooter"}, "multipart/mixed", ""},
+		{signed, listPolicy{Footer: "footer"}, []string{"\r\n\r\n-----BEGIN PGP SIGNED MESSAGE-----\r\nbody\r\n"}, "", "footer"},
+	}
+	s := testSession(t, &Settings{})
+	for i, c := range cases {
+		m := parseMessage([]byte(c.msg))
+		if err := s.decorate(m, "list@example.com", testPolicy(t, c.policy)); err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		out := string(m.bytes())
+		for _, w := range c.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("case %d: %q not in:\n%s", i, w, out)
+			}
+		}
+		if c.ctype != "" && !strings.HasPrefix(m.get("Content-Type"), c.ctype) {
+			t.Errorf("case %d: Content-Type %q, want %s", i, m.get("Content-Type"), c.ctype)
+		}
+		if c.absent != "" && strings.Contains(out, c.absent) {
+			t.Errorf("case %d: %q in:\n%s", i, c.absent, out)
+		}
+	}
+}
+
+// TestDecorateVariants decorates two variants parsed from the same data, as
+// queue does for a post to two lists: each must keep its own footer.
+func TestDecorateVariants(t *testing.T) {
+	raw := []byte("From: joe@example.org\r\nSubject: hello\r\n\r\nbody\r\n")
+	raw = append(make([]byte, 0, 1024), raw...) //spare capacity, as m.bytes() may leave
+	s := testSession(t, &Settings{})
+	var ms []*message
+	for _, l := range []string{"one@example.com", "two@example.com"} {
+		m := parseMessage(raw)
+		if err := s.decorate(m, l, testPolicy(t, listPolicy{Footer: "{{.List}}"})); err != nil {
+			t.Fatal(err)
+		}
+		ms = append(ms, m)
+	}
+	for i, l := range []string{"one@example.com", "two@example.com"} {
+		if out := ms[i].bytes(); !bytes.HasSuffix(out, []byte("body\r\n"+l+"\r\n")) {
+			t.Errorf("variant %d: want footer %s, got:\n%s", i, l, out)
+		}
+	}
+	if string(raw) != "From: joe@example.org\r\nSubject: hello\r\n\r\nbody\r\n" {
+		t.Errorf("original modified:\n%s", raw)
+	}
+}
@@ -0,0 +1,352 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM verification results (RFC8601, 2.7.1)
+const (
+	DKIM_PASS      = "pass"
+	DKIM_FAIL      = "fail"
+	DKIM_NEUTRAL   = "neutral"
+	DKIM_TEMPERROR = "temperror"
+	DKIM_PERMERROR = "permerror"
+)
+
+const maxDKIMSigs = 5 //signatures verified per message
+
+type dkimResult struct {
+	result   string
+	reason   string
+	domain   string //d=
+	selector string //s=
+	ident    string //i=
+	b        string //leading part of b=, to tell signatures apart
+}
+
+var (
+	reWSP    = regexp.MustCompile(`[ \t]+`)
+	reFWS    = regexp.MustCompile(`[ \t\r\n]+`)
+	reTagB   = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+	errDKIMT = errors.New("temporary key lookup failure")
+)
+
+// parseTags parses a tag=value list (RFC6376, 3.2).
+func parseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(list, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[eq+1:])
+	}
+	return tags, nil
+}
+
+// canonHeader canonicalizes a header field, including the trailing CRLF.
+func canonHeader(h header, relaxed bool) string {
+	if !relaxed {
+		return h.raw + "\r\n"
+	}
+	name := strings.ToLower(strings.TrimSpace(h.name))
+	value := strings.Replace(h.value(), "\r\n", "", -1)
+	value = strings.TrimSpace(reWSP.ReplaceAllString(value, " "))
+	return name + ":" + value + "\r\n"
+}
+
+// canonBody canonicalizes a message body (RFC6376, 3.4.3 and 3.4.4).
+func canonBody(body []byte, relaxed bool) []byte {
+	if relaxed {
+		lines := bytes.Split(body, []byte("\r\n"))
+		for i, l := range lines {
+			lines[i] = bytes.TrimRight(reWSP.ReplaceAll(l, []byte(" ")), " ")
+		}
+		body = bytes.Join(lines, []byte("\r\n"))
+	}
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if len(body) > 0 || !relaxed {
+		body = append(body, '\r', '\n')
+	}
+	return body
+}
+
+// dkimCanon parses the c= tag into header and body canonicalization.
+func dkimCanon(c string) (hrelaxed, brelaxed bool, err error) {
+	if c == "" {
+		c = "simple/simple"
+	}
+	p := strings.SplitN(strings.ToLower(c), "/", 2)
+	if len(p) == 1 {
+		p = append(p, "simple")
+	}
+	for i, a := range p {
+		switch a {
+		case "simple":
+		case "relaxed":
+			if i == 0 {
+				hrelaxed = true
+			} else {
+				brelaxed = true
+			}
+		default:
+			return false, false, fmt.Errorf("unknown canonicalization %q", a)
+		}
+	}
+	return
+}
+
+// dkimHeaders returns the canonicalized headers listed in fields, selecting
+// multiple instances from the bottom up (RFC6376, 5.4.2).
+func dkimHeaders(m *message, fields []string, relaxed bool) string {
+	used := make(map[int]bool)
+	var buf bytes.Buffer
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		for i := len(m.hdrs) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(strings.TrimSpace(m.hdrs[i].name), f) {
+				used[i] = true
+				buf.WriteString(canonHeader(m.hdrs[i], relaxed))
+				break
+			}
+		}
+	}
+	return buf.String()
+}
+
+// dkimKey retrieves the public key of selector._domainkey.domain.
+func (s *Settings) dkimKey(selector, domain string) (crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	txts, err := s.dns.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, errors.New("no key for signature")
+		}
+		return nil, errDKIMT
+	}
+	if len(txts) != 1 {
+		return nil, errors.New("no unique key for signature")
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("invalid key version")
+	}
+	p := reFWS.ReplaceAllString(tags["p"], "")
+	if p == "" {
+		return nil, errors.New("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed key")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(der)
+		}
+		if err != nil {
+			return nil, errors.New("malformed key")
+		}
+		rk, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("key type mismatch")
+		}
+		if rk.N.BitLen() < 1024 {
+			return nil, errors.New("key too short") //RFC8301, 3.2
+		}
+		return rk, nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed key")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, errors.New("unknown key type")
+}
+
+// verifySig verifies one DKIM-Signature header of m.
+func (s *Settings) verifySig(m *message, sig header) (r dkimResult) {
+	r.result = DKIM_PERMERROR
+	tags, err := parseTags(sig.unfolded())
+	if err != nil {
+		r.reason = err.Error()
+		return
+	}
+	r.domain = strings.ToLower(tags["d"])
+	r.selector = tags["s"]
+	r.ident = tags["i"]
+	b := reFWS.ReplaceAllString(tags["b"], "")
+	if len(b) > 8 {
+		r.b = b[:8]
+	} else {
+		r.b = b
+	}
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			r.reason = "missing tag " + t
+			return
+		}
+	}
+	if tags["v"] != "1" {
+		r.reason = "invalid version"
+		return
+	}
+	if r.ident == "" {
+		r.ident = "@" + r.domain
+	}
+	idom := strings.ToLower(r.ident[strings.LastIndex(r.ident, "@")+1:])
+	if idom != r.domain && !strings.HasSuffix(idom, "."+r.domain) {
+		r.reason = "identity not within signing domain"
+		return
+	}
+	fields := strings.Split(tags["h"], ":")
+	signed := false
+	for _, f := range fields {
+		if strings.EqualFold(strings.TrimSpace(f), "from") {
+			signed = true
+		}
+	}
+	if !signed {
+		r.reason = "From not signed"
+		return
+	}
+	if x := tags["x"]; x != "" {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil || time.Now().Unix() > exp {
+			r.result, r.reason = DKIM_FAIL, "signature expired"
+			return
+		}
+	}
+	hrelaxed, brelaxed, err := dkimCanon(tags["c"])
+	if err != nil {
+		r.reason = err.Error()
+		return
+	}
+	algo := strings.ToLower(tags["a"])
+	if algo != "rsa-sha256" && algo != "ed25519-sha256" {
+		r.reason = "unsupported algorithm " + algo
+		return
+	}
+	if tags["l"] != "" {
+		//content appended beyond the body length would pass as signed
+		r.reason = "body length limit not accepted"
+		return
+	}
+	body := canonBody(m.body, brelaxed)
+	bh := sha256.Sum256(body)
+	if base64.StdEncoding.EncodeToString(bh[:]) != reFWS.ReplaceAllString(tags["bh"], "") {
+		r.result, r.reason = DKIM_FAIL, "body hash mismatch"
+		return
+	}
+	sigval, err := base64.StdEncoding.DecodeString(b)
+	if err != nil {
+		r.reason = "malformed signature"
+		return
+	}
+	key, err := s.dkimKey(r.selector, r.domain)
+	if err != nil {
+		if err == errDKIMT {
+			r.result = DKIM_TEMPERROR
+		}
+		r.reason = err.Error()
+		return
+	}
+	bare := header{sig.name, sig.name + ":" + reTagB.ReplaceAllString(sig.value(), "$1$2")}
+	data := dkimHeaders(m, fields, hrelaxed) + strings.TrimSuffix(canonHeader(bare, hrelaxed), "\r\n")
+	r.result = DKIM_PASS
+	if !checkSig(key, algo, data, sigval) {
+		r.result, r.reason = DKIM_FAIL, "signature verification failed"
+	}
+	return
+}
+
+// checkSig checks sig, made with algo, over the canonicalized data.
+func checkSig(key crypto.PublicKey, algo string, data string, sig []byte) bool {
+	hash := sha256.Sum256([]byte(data))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return algo == "rsa-sha256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return algo == "ed25519-sha256" && ed25519.Verify(k, hash[:], sig)
+	}
+	return false
+}
+
+// verifyDKIM verifies the DKIM signatures of m, top to bottom.
+func (s *Settings) verifyDKIM(m *message) []dkimResult {
+	var rs []dkimResult
+	for _, sig := range m.getAll("DKIM-Signature") {
+		if len(rs) == maxDKIMSigs {
+			break
+		}
+		rs = append(rs, s.verifySig(m, sig))
+	}
+	return rs
+}
+
+// aligned reports whether the domains are in relaxed alignment, that is, one
+// of them equals or is a subdomain of the other.
+func aligned(d1, d2 string) bool {
+	d1, d2 = strings.ToLower(d1), strings.ToLower(d2)
+	if !strings.Contains(d1, ".") || !strings.Contains(d2, ".") {
+		return false
+	}
+	return d1 == d2 || strings.HasSuffix(d1, "."+d2) || strings.HasSuffix(d2, "."+d1)
+}
+
+// dkimAligned reports whether a valid signature aligned with domain exists.
+func dkimAligned(rs []dkimResult, domain string) bool {
+	for _, r := range rs {
+		if r.result == DKIM_PASS && aligned(r.domain, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r dkimResult) String() string {
+	s := "dkim=" + r.result
+	if r.reason != "" {
+		s += " (" + r.reason + ")"
+	}
+	if r.domain != "" {
+		s += " header.d=" + r.domain
+	}
+	if r.selector != "" {
+		s += " header.s=" + r.selector
+	}
+	if strings.ContainsAny(r.b, "/=") {
+		s += " header.b=\"" + r.b + "\""
+	} else if r.b != "" {
+		s += " header.b=" + r.b
+	}
+	return s
+}
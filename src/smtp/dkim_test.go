@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// the signed message of RFC8463, Appendix A
+var rfc8463Msg = crlf(`DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`)
+
+func TestDKIMVector(t *testing.T) {
+	s := &Settings{dns: &fileResolver{txt: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}}}
+	rs := s.verifyDKIM(parseMessage([]byte(rfc8463Msg)))
+	if len(rs) != 1 || rs[0].result != DKIM_PASS || rs[0].domain != "football.example.com" || rs[0].selector != "brisbane" {
+		t.Fatalf("results %v", rs)
+	}
+	if !dkimAligned(rs, "Football.Example.com") || dkimAligned(rs, "example.net") {
+		t.Error("alignment")
+	}
+	tampered := strings.Replace(rfc8463Msg, "Are you hungry", "Are you thirsty", 1)
+	if rs = s.verifyDKIM(parseMessage([]byte(tampered))); rs[0].result != DKIM_FAIL || rs[0].reason != "body hash mismatch" {
+		t.Errorf("tampered body: %v", rs)
+	}
+}
+
+// dkimSettings returns settings signing for example.com with key, whose
+// public key is published under selector "test".
+func dkimSettings(t *testing.T, key interface{}) *Settings {
+	var p, algo string
+	ds := &dkimSigner{selector: "test"}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, algo, ds.key = "k=rsa; p="+base64.StdEncoding.EncodeToString(der), "rsa-sha256", k
+	case ed25519.PrivateKey:
+		pub := k.Public().(ed25519.PublicKey)
+		p, algo, ds.key = "k=ed25519; p="+base64.StdEncoding.EncodeToString(pub), "ed25519-sha256", k
+	}
+	ds.algo = algo
+	return &Settings{
+		dns: &fileResolver{txt: map[string][]string{
+			"test._domainkey.example.com":    {"v=DKIM1; " + p},
+			"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		}},
+		signers: map[string]*dkimSigner{"example.com": ds},
+	}
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := crlf("From: Joe <joe@example.com>\nTo: list@example.org\nSubject: hello\n\nbody  text\n")
+	for _, c := range []struct {
+		change func(string) string //applied to the signed message
+		result string
+		reason string
+	}{
+		{func(m string) string { return m }, DKIM_PASS, ""},
+		{func(m string) string { return strings.Replace(m, "Subject: hello", "Subject:   hello ", 1) }, DKIM_PASS, ""},
+		{func(m string) string { return m + "\r\n\r\n" }, DKIM_PASS, ""},
+		{func(m string) string { return strings.Replace(m, "body  text", "body\ttext ", 1) }, DKIM_PASS, ""},
+		{func(m string) string { return "Received: from elsewhere\r\n" + m }, DKIM_PASS, ""},
+		{func(m string) string { return strings.Replace(m, "Subject: hello", "Subject: hi", 1) }, DKIM_FAIL, "signature verification failed"},
+		{func(m string) string { return strings.Replace(m, "\r\n\r\n", "\r\nSubject: hi\r\n\r\n", 1) }, DKIM_FAIL, "signature verification failed"},
+		{func(m string) string { return m + "more\r\n" }, DKIM_FAIL, "body hash mismatch"},
+		{func(m string) string { return strings.Replace(m, "s=test;", "s=none;", 1) }, DKIM_PERMERROR, "no key for signature"},
+		{func(m string) string { return strings.Replace(m, "s=test;", "s=revoked;", 1) }, DKIM_PERMERROR, "key revoked"},
+		{func(m string) string { return strings.Replace(m, "s=test;", "s=test; l=5;", 1) }, DKIM_PERMERROR, "body length limit not accepted"},
+		{func(m string) string { return strings.Replace(m, "h=from:", "h=", 1) }, DKIM_PERMERROR, "From not signed"},
+	} {
+		for _, key := range []interface{}{edKey, rsaKey} {
+			s := dkimSettings(t, key)
+			m := parseMessage([]byte(msg))
+			if err := s.dkimSign(m, "mail.example.com"); err != nil {
+				t.Fatal(err)
+			}
+			signed := c.change(string(m.bytes()))
+			rs := s.verifyDKIM(parseMessage([]byte(signed)))
+			if len(rs) != 1 || rs[0].result != c.result || rs[0].reason != c.reason {
+				t.Errorf("%T: %v, want %s (%s) for:\n%s", key, rs, c.result, c.reason, signed)
+			}
+		}
+	}
+}
+
+func TestCanonBody(t *testing.T) {
+	for _, c := range []struct {
+		body            string
+		simple, relaxed string
+	}{
+		{"", "\r\n", ""},
+		{"\r\n\r\n", "\r\n", ""},
+		{" C \r\nD \t E\r\n\r\n\r\n", " C \r\nD \t E\r\n", " C\r\nD E\r\n"},
+	} {
+		if got := string(canonBody([]byte(c.body), false)); got != c.simple {
+			t.Errorf("simple %q: %q, want %q", c.body, got, c.simple)
+		}
+		if got := string(canonBody([]byte(c.body), true)); got != c.relaxed {
+			t.Errorf("relaxed %q: %q, want %q", c.body, got, c.relaxed)
+		}
+	}
+}
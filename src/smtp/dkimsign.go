@@ -0,0 +1,165 @@
+package smtp
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// signingKey configures DKIM signing for a domain.  KeyFile is a PEM file
+// holding an RSA (PKCS1 or PKCS8) or Ed25519 (PKCS8) private key, whose
+// public key is published at <Selector>._domainkey.<domain>.
+type signingKey struct {
+	Selector string
+	KeyFile  string
+}
+
+type dkimSigner struct {
+	selector string
+	algo     string
+	key      crypto.Signer
+}
+
+// headers signed when present, in addition to From
+var dkimSigned = []string{"from", "sender", "reply-to", "to", "cc", "subject",
+	"date", "message-id", "in-reply-to", "references", "mime-version",
+	"content-type", "content-transfer-encoding", "list-id", "list-post",
+	"list-help", "list-subscribe", "list-unsubscribe", "list-unsubscribe-post",
+	"list-owner", "list-archive"}
+
+func loadSigningKey(file string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(file + ": no PEM data")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, errors.New(file + ": unsupported key type")
+}
+
+func (s *Settings) compileDKIM() error {
+	for domain, sk := range s.DKIMKeys {
+		if sk.Selector == "" {
+			return fmt.Errorf("DKIM key for %s: missing selector", domain)
+		}
+		key, err := loadSigningKey(sk.KeyFile)
+		if err != nil {
+			return fmt.Errorf("DKIM key for %s: %v", domain, err)
+		}
+		algo := "rsa-sha256"
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			algo = "ed25519-sha256"
+		}
+		s.signers[strings.ToLower(domain)] = &dkimSigner{sk.Selector, algo, key}
+	}
+	return nil
+}
+
+// signer returns the signing domain and key for domain, which may be that of
+// a parent domain.
+func (s *Settings) signer(domain string) (string, *dkimSigner) {
+	d := strings.ToLower(domain)
+	for {
+		if ds, ok := s.signers[d]; ok {
+			return d, ds
+		}
+		dot := strings.Index(d, ".")
+		if dot < 0 {
+			return "", nil
+		}
+		d = d[dot+1:]
+	}
+}
+
+// pickSigner returns the signing domain and key of the first of domains for
+// which a key is configured.
+func (s *Settings) pickSigner(domains ...string) (string, *dkimSigner) {
+	for _, domain := range domains {
+		if d, ds := s.signer(domain); ds != nil {
+			return d, ds
+		}
+	}
+	return "", nil
+}
+
+// dkimSign adds a DKIM-Signature to m, signed as the first of domains for
+// which a key is configured.  m is left unchanged if there is none.
+func (s *Settings) dkimSign(m *message, domains ...string) error {
+	d, ds := s.pickSigner(domains...)
+	if ds == nil {
+		return nil
+	}
+	fields := signedFields(m)
+	bh := sha256.Sum256(canonBody(m.body, true))
+	sig := header{"DKIM-Signature", fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		ds.algo, d, ds.selector, time.Now().Unix(), strings.Join(fields, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))}
+	b, err := ds.sign(dkimHeaders(m, fields, true) + strings.TrimSuffix(canonHeader(sig, true), "\r\n"))
+	if err != nil {
+		return err
+	}
+	sig.raw += b
+	m.hdrs = append([]header{sig}, m.hdrs...)
+	return nil
+}
+
+// sign signs the canonicalized data, returning the folded b= value.
+func (ds *dkimSigner) sign(data string) (string, error) {
+	hash := sha256.Sum256([]byte(data))
+	var b []byte
+	var err error
+	if ds.algo == "ed25519-sha256" {
+		b, err = ds.key.Sign(nil, hash[:], crypto.Hash(0))
+	} else {
+		b, err = ds.key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	enc := base64.StdEncoding.EncodeToString(b)
+	folded := ""
+	for len(enc) > 64 {
+		folded += enc[:64] + "\r\n\t "
+		enc = enc[64:]
+	}
+	return folded + enc, nil
+}
+
+// signedFields returns the fields of m to sign, From always included.
+func signedFields(m *message, extra ...string) []string {
+	var fields []string
+	for _, f := range append(dkimSigned, extra...) {
+		for range m.getAll(f) {
+			fields = append(fields, f)
+		}
+	}
+	if len(m.getAll("from")) == 0 {
+		fields = append(fields, "from")
+	}
+	return fields
+}
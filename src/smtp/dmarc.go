@@ -0,0 +1,182 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// DMARC mitigations of list posts
+const (
+	DMARC_MUNGE = "munge" //From is replaced by the list address
+	DMARC_WRAP  = "wrap"  //post is wrapped in a message/rfc822 from the list
+)
+
+var errDMARCPerm = errors.New("invalid DMARC record")
+
+type dmarcResult struct {
+	domain string //From domain
+	policy string //none, quarantine, reject or "" without a DMARC record
+	result string //pass, fail, none, temperror or permerror
+}
+
+// lookupDMARC finds the DMARC policy of domain, walking up the tree to find
+// the record of the organizational domain (the sp= policy applies there).
+// The walk replaces the public suffix list, which we do not have.
+func (s *Settings) lookupDMARC(domain string) (string, error) {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	for i := 0; i < len(labels)-1 && i < 8; i++ {
+		txts, err := s.dns.LookupTXT(ctx, "_dmarc."+strings.Join(labels[i:], "."))
+		if err != nil && !isNotFound(err) {
+			return "", err
+		}
+		for _, txt := range txts {
+			if !strings.HasPrefix(txt, "v=DMARC1") {
+				continue
+			}
+			tags, err := parseTags(txt)
+			if err != nil {
+				return "", errDMARCPerm
+			}
+			p := tags["p"]
+			if sp, ok := tags["sp"]; ok && i > 0 {
+				p = sp
+			}
+			switch p {
+			case "none", "quarantine", "reject":
+				return p, nil
+			}
+			return "", errDMARCPerm
+		}
+	}
+	return "", nil
+}
+
+// evalDMARC evaluates the DMARC policy of the author's domain against the SPF
+// and DKIM results of the message (RFC7489, 3.1, relaxed alignment).
+func (s *svrSession) evalDMARC(m *message) *dmarcResult {
+	d := &dmarcResult{domain: addrDomain(m.get("From"))}
+	if d.domain == "" {
+		d.result = "permerror"
+		return d
+	}
+	policy, err := s.lookupDMARC(d.domain)
+	switch {
+	case err == errDMARCPerm:
+		d.result = "permerror"
+		return d
+	case err != nil:
+		d.result = "temperror"
+		return d
+	case policy == "":
+		d.result = "none"
+		return d
+	}
+	d.policy = policy
+	spfDomain := s.helo
+	if s.sender != "" {
+		spfDomain = s.sender[strings.LastIndex(s.sender, "@")+1:]
+	}
+	if s.spf == SPF_PASS && aligned(spfDomain, d.domain) || dkimAligned(s.dkim, d.domain) {
+		d.result = "pass"
+	} else {
+		d.result = "fail"
+	}
+	return d
+}
+
+func (d dmarcResult) String() string {
+	s := "dmarc=" + d.result
+	if d.policy != "" {
+		s += " (p=" + d.policy + ")"
+	}
+	if d.domain != "" {
+		s += " header.from=" + d.domain
+	}
+	return s
+}
+
+// listFrom returns the From header to replace the author's: "Name via List
+// <list@domain>".
+func listFrom(from string, list string, name string) string {
+	author := from
+	if a, err := mail.ParseAddress(from); err == nil {
+		author = a.Name
+		if author == "" {
+			author = a.Address
+		}
+	}
+	return (&mail.Address{Name: author + " via " + name, Address: list}).String()
+}
+
+// mitigateDMARC rewrites m, a post to list, if the author's domain publishes
+// a quarantine or reject DMARC policy, which the post would fail once the
+// list modified it.  It reports whether it did.
+func (s *svrSession) mitigateDMARC(m *message, list string, p listPolicy) bool {
+	if p.DMARC != DMARC_MUNGE && p.DMARC != DMARC_WRAP {
+		return false
+	}
+	if s.dmarc == nil {
+		s.dmarc = s.evalDMARC(m)
+	}
+	if s.dmarc.policy != "quarantine" && s.dmarc.policy != "reject" {
+		return false
+	}
+	from := m.get("From")
+	munged := "From: " + listFrom(from, list, p.name(list))
+	s.Debugf("%s>   DMARC p=%s, %s: %s", s.CliAddr(), s.dmarc.policy, p.DMARC, munged)
+	if p.DMARC == DMARC_WRAP {
+		s.wrap(m, munged, from, list, p)
+		return true
+	}
+	m.remove("From", func(header) bool { return true })
+	m.insert(munged)
+	s.keepAuthor(m, from, p)
+	return true
+}
+
+// keepAuthor adds the original author of a munged or wrapped post to the
+// Reply-To (unless there is one already) or Cc header.
+func (s *svrSession) keepAuthor(m *message, from string, p listPolicy) {
+	if from == "" {
+		return
+	}
+	if strings.EqualFold(p.MungeTo, "cc") {
+		if cc := m.get("Cc"); cc != "" {
+			m.remove("Cc", func(header) bool { return true })
+			from = cc + ", " + from
+		}
+		m.insert("Cc: " + from)
+	} else if m.get("Reply-To") == "" {
+		m.insert("Reply-To: " + from)
+	}
+}
+
+// wrap replaces m by a message from the list, with the original post as a
+// message/rfc822 attachment.  Our own trace headers stay on the outside.
+func (s *svrSession) wrap(m *message, munged string, from string, list string, p listPolicy) {
+	trace := 0
+	for i, h := range m.hdrs {
+		if strings.EqualFold(strings.TrimSpace(h.name), "Received") {
+			trace = i + 1
+			break
+		}
+	}
+	inner := &message{m.hdrs[trace:], m.body}
+	m.hdrs = append([]header{}, m.hdrs[:trace]...)
+	m.insert(munged)
+	for _, f := range []string{"To", "Cc", "Subject", "Date", "In-Reply-To", "References"} {
+		for _, h := range inner.getAll(f) {
+			m.hdrs = append(m.hdrs, h)
+		}
+	}
+	s.keepAuthor(m, from, p)
+	m.insert("Message-ID: <" + newMsgId() + "@" + list[strings.LastIndex(list, "@")+1:] + ">")
+	m.insert("MIME-Version: 1.0")
+	m.insert("Content-Type: message/rfc822")
+	m.insert("Content-Disposition: inline")
+	m.body = inner.bytes()
+}
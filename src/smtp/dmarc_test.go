@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// timeoutResolver fails every lookup as timed out.
+type timeoutResolver struct{ noAddrResolver }
+
+func (timeoutResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+}
+
+var dmarcZone = &fileResolver{txt: map[string][]string{
+	"_dmarc.example.com":      {"v=spf1 -all", "v=DMARC1; p=quarantine; sp=none"},
+	"_dmarc.reject.example":   {"v=DMARC1; p=reject; rua=mailto:dmarc@reject.example"},
+	"_dmarc.none.example.org": {"v=DMARC1; p=none"},
+	"_dmarc.bad.example.org":  {"v=DMARC1; p=bogus"},
+}}
+
+func TestEvalDMARC(t *testing.T) {
+	pass := []dkimResult{{result: DKIM_PASS, domain: "example.com"}}
+	for _, c := range []struct {
+		from   string
+		sender string //envelope sender, SPF passed for it
+		dkim   []dkimResult
+		result string
+		policy string
+	}{
+		{"Joe <joe@example.com>", "joe@example.com", nil, "pass", "quarantine"},
+		{"joe@example.com", "bounces@mail.example.com", nil, "pass", "quarantine"},
+		{"joe@example.com", "joe@example.net", nil, "fail", "quarantine"},
+		{"joe@example.com", "joe@example.net", pass, "pass", "quarantine"},
+		{"joe@example.com", "joe@example.net", []dkimResult{{result: DKIM_FAIL, domain: "example.com"}}, "fail", "quarantine"},
+		{"joe@example.com", "joe@example.net", []dkimResult{{result: DKIM_PASS, domain: "example.net"}}, "fail", "quarantine"},
+		{"joe@sub.example.com", "joe@example.net", nil, "fail", "none"},
+		{"joe@a.b.reject.example", "joe@example.net", nil, "fail", "reject"},
+		{"joe@none.example.org", "joe@example.net", nil, "fail", "none"},
+		{"joe@example.net", "joe@example.net", nil, "none", ""},
+		{"joe@bad.example.org", "joe@example.net", nil, "permerror", ""},
+		{"", "joe@example.net", nil, "permerror", ""},
+	} {
+		s := testSession(t, &Settings{dns: dmarcZone})
+		s.sender, s.spf, s.dkim = c.sender, SPF_PASS, c.dkim
+		m := parseMessage([]byte(crlf("From: " + c.from + "\n\nbody\n")))
+		if d := s.evalDMARC(m); d.result != c.result || d.policy != c.policy {
+			t.Errorf("From %s, sender %s, %v: %s", c.from, c.sender, c.dkim, d)
+		}
+	}
+	s := testSession(t, &Settings{dns: timeoutResolver{}})
+	if d := s.evalDMARC(parseMessage([]byte("From: joe@example.com\r\n\r\n"))); d.result != "temperror" {
+		t.Errorf("lookup timeout: %s", d)
+	}
+}
+
+func TestMitigateDMARC(t *testing.T) {
+	msg := crlf("Received: from x by y\nFrom: Joe <joe@example.com>\nTo: list@example.org\nSubject: hi\nDKIM-Signature: v=1; d=example.com\n\nbody\n")
+	for _, c := range []struct {
+		policy listPolicy
+		from   string //domain of the author
+		munged bool
+		want   []string
+		absent []string
+	}{
+		{listPolicy{}, "example.com", false, []string{"From: Joe <joe@example.com>\r\n"}, []string{"via"}},
+		{listPolicy{DMARC: DMARC_MUNGE}, "example.net", false, []string{"From: Joe <joe@example.net>\r\n"}, []string{"via"}},
+		{listPolicy{DMARC: DMARC_MUNGE}, "example.com", true,
+			[]string{"From: \"Joe via list\" <list@example.org>\r\n", "Reply-To: Joe <joe@example.com>\r\n", "DKIM-Signature"},
+			[]string{"From: Joe"}},
+		{listPolicy{DMARC: DMARC_MUNGE, MungeTo: "Cc", Name: "The List"}, "example.com", true,
+			[]string{"From: \"Joe via The List\" <list@example.org>\r\n", "Cc: Joe <joe@example.com>\r\n"},
+			[]string{"Reply-To"}},
+		{listPolicy{DMARC: DMARC_WRAP}, "example.com", true,
+			[]string{"Received: from x by y\r\nFrom: \"Joe via list\" <list@example.org>\r\nTo: list@example.org\r\nSubject: hi\r\n",
+				"Content-Type: message/rfc822\r\n", "\r\n\r\nFrom: Joe <joe@example.com>\r\n", "DKIM-Signature: v=1; d=example.com\r\n\r\nbody\r\n"},
+			nil},
+	} {
+		s := testSession(t, &Settings{dns: dmarcZone})
+		s.sender, s.spf = "joe@"+c.from, SPF_PASS
+		m := parseMessage([]byte(strings.Replace(msg, "example.com", c.from, -1)))
+		munged := s.mitigateDMARC(m, "list@example.org", c.policy)
+		out := string(m.bytes())
+		if munged != c.munged {
+			t.Errorf("%v: mitigated %v", c.policy, munged)
+		}
+		for _, w := range c.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%v: %q not in:\n%s", c.policy, w, out)
+			}
+		}
+		for _, a := range c.absent {
+			if strings.Contains(out, a) {
+				t.Errorf("%v: %q in:\n%s", c.policy, a, out)
+			}
+		}
+	}
+}
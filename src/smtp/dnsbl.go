@@ -0,0 +1,164 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type blocklist struct {
+	Zone   string
+	Check  []string //what to look up: "ip" (default), "helo", "sender"
+	Reject bool     //reject listed clients, otherwise add Score
+	Score  int
+}
+
+type dnsblResult struct {
+	listed  bool
+	reason  string
+	expires time.Time
+}
+
+const dnsblCacheMax = 10000 //entries, expired ones are dropped beyond that
+
+// dnsblCache caches blocklist answers for all sessions.
+type dnsblCache struct {
+	sync.Mutex
+	entries map[string]dnsblResult
+}
+
+func (b blocklist) checks(kind string) bool {
+	if len(b.Check) == 0 {
+		return kind == "ip"
+	}
+	for _, c := range b.Check {
+		if strings.EqualFold(c, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseIP returns the DNSBL query prefix of ip, i.e. reversed octets for
+// IPv4 and reversed nibbles for IPv6 (RFC5782, 2.1 and 2.4).
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	ip = ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// dnsblQuery looks up name (e.g. "2.0.0.127.zen.example.org") through the
+// resolver.  Answers are cached, and a query that does not complete within
+// DNSBLTimeout counts as not listed.
+func (s *Settings) dnsblQuery(name string) (bool, string) {
+	s.dnsblCache.Lock()
+	r, ok := s.dnsblCache.entries[name]
+	s.dnsblCache.Unlock()
+	if ok && time.Now().Before(r.expires) {
+		return r.listed, r.reason
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.DNSBLTimeout)*time.Second)
+	defer cancel()
+	r = dnsblResult{}
+	ips, err := s.dns.LookupIP(ctx, name)
+	if err == nil {
+		for _, ip := range ips {
+			//127.0.0.0/8 means listed (RFC5782, 2.1), except for the
+			//127.255.255.0/24 error codes some lists return
+			ip4 := ip.To4()
+			if ip4 != nil && ip4[0] == 127 && !(ip4[1] == 255 && ip4[2] == 255) {
+				r.listed = true
+			}
+		}
+	}
+	if r.listed {
+		txt, err := s.dns.LookupTXT(ctx, name)
+		if err == nil && len(txt) > 0 {
+			r.reason = printable(txt[0]) //goes into our reply
+		}
+	}
+	if ctx.Err() != nil {
+		s.Logf("RUNERR: DNSBL query timed out: %s", name)
+		return false, ""
+	}
+	now := time.Now()
+	r.expires = now.Add(10 * time.Minute)
+	s.dnsblCache.Lock()
+	if len(s.dnsblCache.entries) >= dnsblCacheMax {
+		for k, e := range s.dnsblCache.entries {
+			if now.After(e.expires) {
+				delete(s.dnsblCache.entries, k)
+			}
+		}
+		if len(s.dnsblCache.entries) >= dnsblCacheMax {
+			s.dnsblCache.entries = make(map[string]dnsblResult)
+		}
+	}
+	s.dnsblCache.entries[name] = r
+	s.dnsblCache.Unlock()
+	return r.listed, r.reason
+}
+
+// dnsbl checks target, an IP address ("ip") or a domain ("helo", "sender"),
+// against the blocklists configured for that kind.  The lists are queried in
+// parallel; it returns a rejection reply, or "" after adding the scores of
+// listing (non-rejecting) lists to the session score.
+func (s *svrSession) dnsbl(kind string, target string) string {
+	if len(s.DNSBL) == 0 || target == "" || s.lmtp || s.openRelayAllowed() {
+		return ""
+	}
+	prefix := strings.Trim(target, "[]")
+	if kind == "ip" {
+		prefix = reverseIP(net.ParseIP(target))
+	} else if net.ParseIP(prefix) != nil || strings.HasPrefix(prefix, "IPv6:") {
+		return "" //address literal, not a domain
+	}
+	type answer struct {
+		b      blocklist
+		listed bool
+		reason string
+	}
+	answers := make(chan answer)
+	cnt := 0
+	for _, b := range s.DNSBL {
+		if !b.checks(kind) {
+			continue
+		}
+		cnt++
+		go func(b blocklist) {
+			listed, reason := s.dnsblQuery(prefix + "." + b.Zone)
+			answers <- answer{b, listed, reason}
+		}(b)
+	}
+	reply := ""
+	for ; cnt > 0; cnt-- {
+		a := <-answers
+		if !a.listed {
+			continue
+		}
+		s.Logf("DNSBL: %s %s listed in %s (%s)", kind, target, a.b.Zone, a.reason)
+		if a.b.Reject {
+			reply = fmt.Sprintf("%s blocked using %s", target, a.b.Zone)
+			if a.reason != "" {
+				reply += "; " + a.reason
+			}
+		} else if !s.listed[kind+" "+a.b.Zone] {
+			s.listed[kind+" "+a.b.Zone] = true
+			s.score += a.b.Score
+		}
+	}
+	if reply == "" && s.DNSBLReject > 0 && s.score >= s.DNSBLReject {
+		reply = fmt.Sprintf("%s blocked, DNSBL score %d", target, s.score)
+	}
+	return reply
+}
@@ -17,6 +17,9 @@ type envelope struct {
 	Recipients []string
 	Attempted  int
 	Origin     string
+	Lists      map[string]string `json:",omitempty"` //recipient => list
+	Held       string            `json:",omitempty"` //reason for holding
+	SRS        string            `json:",omitempty"` //rewritten sender, used instead of Origin
 	domain     string
 	file       string
 	content    string
@@ -89,10 +92,10 @@ func loadEnvelope(file string, ss *Settings) *envelope {
 
 func (e *envelope) recErr(rcpt string, msg string, fatal bool) {
 	if fatal {
-		e.Logf("RUNERR: " + msg)
+		e.Log("RUNERR: " + msg)
 		e.errors[rcpt] = "!" + msg
 	} else {
-		e.Debugf("RUNERR: " + msg)
+		e.Debug("RUNERR: " + msg)
 		e.errors[rcpt] = "?" + msg
 	}
 }
@@ -163,8 +166,16 @@ func (e *envelope) flush(final bool) {
 	return
 }
 
+// returnPath returns the envelope sender to deliver the message with.
+func (e *envelope) returnPath() string {
+	if e.SRS != "" {
+		return e.SRS
+	}
+	return e.Origin
+}
+
 func (e envelope) bounce(failed []string, errmsg string) {
-	if e.Sender == e.Origin {
+	if e.Sender == e.Origin || e.Sender == "" {
 		return //Bounce of bounced messages are not allowed
 	}
 	var err error
@@ -219,7 +230,12 @@ func (e envelope) bounce(failed []string, errmsg string) {
 		msg.Write([]byte(line))
 		cnt++
 	}
-	_, err = msg.WriteTo(bmsg)
+	m := parseMessage(msg.Bytes())
+	err = e.dkimSign(m, e.Origin[strings.LastIndex(e.Origin, "@")+1:])
+	if err != nil {
+		return
+	}
+	_, err = bmsg.Write(m.bytes())
 	if err != nil {
 		return
 	}
@@ -0,0 +1,167 @@
+package smtp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type greylist struct {
+	Enabled bool
+	Delay   int //seconds before a retry is accepted
+	Retry   int //seconds an unconfirmed triplet is kept
+	Expire  int //seconds a confirmed triplet is kept after last use
+}
+
+type triplet struct {
+	First  int64
+	Last   int64
+	Passed bool
+}
+
+// greyDB is the triplet database, persisted as JSON under Spool.
+type greyDB struct {
+	sync.Mutex
+	file     string
+	triplets map[string]*triplet
+	dirty    bool //changed since saved
+}
+
+// loadGreyDB reads the database, which is empty if the file cannot be read.
+func loadGreyDB(file string) (*greyDB, error) {
+	db := &greyDB{file: file, triplets: make(map[string]*triplet)}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return db, err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&db.triplets); err != nil {
+		db.triplets = make(map[string]*triplet)
+	}
+	return db, err
+}
+
+// save drops expired triplets and writes the database, if changed.
+func (db *greyDB) save(gl greylist) error {
+	db.Lock()
+	now := time.Now().Unix()
+	for k, t := range db.triplets {
+		if (t.Passed && now-t.Last > int64(gl.Expire)) || (!t.Passed && now-t.First > int64(gl.Retry)) {
+			delete(db.triplets, k)
+			db.dirty = true
+		}
+	}
+	if !db.dirty {
+		db.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(db.triplets)
+	db.dirty = err != nil
+	db.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := db.file + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, db.file)
+	}
+	if err != nil {
+		db.Lock()
+		db.dirty = true
+		db.Unlock()
+	}
+	return err
+}
+
+// check records an attempt and tells whether it has to be deferred.
+func (db *greyDB) check(key string, gl greylist) bool {
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now().Unix()
+	t, ok := db.triplets[key]
+	if ok && !t.Passed && now-t.First > int64(gl.Retry) {
+		ok = false //unconfirmed triplet expired, start over
+	}
+	if !ok {
+		db.triplets[key] = &triplet{First: now, Last: now}
+		db.dirty = true
+		return true
+	}
+	if !t.Passed && now-t.First < int64(gl.Delay) {
+		return true
+	}
+	t.Passed = true
+	t.Last = now
+	db.dirty = true
+	return false
+}
+
+// saveGreyDB saves the greylist database every minute.
+func (s *Settings) saveGreyDB() {
+	for range time.Tick(time.Minute) {
+		if err := s.greyDB.save(s.Greylist); err != nil {
+			s.Log("RUNERR: greylist: " + err.Error())
+		}
+	}
+}
+
+func (s *Settings) compileGreylist() (err error) {
+	if !s.Greylist.Enabled {
+		return nil
+	}
+	if s.Greylist.Delay <= 0 {
+		s.Greylist.Delay = 300
+	}
+	if s.Greylist.Retry < s.Greylist.Delay {
+		s.Greylist.Retry = 86400
+	}
+	if s.Greylist.Expire <= 0 {
+		s.Greylist.Expire = 36 * 86400
+	}
+	s.greyDB, err = loadGreyDB(s.Spool + "/greylist.db")
+	if err != nil {
+		s.Logf("RUNERR: greylist %s: %v (starting empty)", s.greyDB.file, err)
+	}
+	go s.saveGreyDB()
+	return nil
+}
+
+// greylisted tells whether RCPT TO:<rcpt> has to be deferred.  OpenRelay
+// clients, authenticated users and list members are never greylisted, nor
+// are recipients that would be rejected anyway.
+func (s *svrSession) greylisted(rcpt string) bool {
+	if s.greyDB == nil || s.openRelayAllowed() {
+		return false
+	}
+	ip := s.cliIP()
+	p := strings.SplitN(rcpt, "@", 2)
+	if ip == nil || len(p) != 2 {
+		return false
+	}
+	if _, ok := s.Routing[p[1]][p[0]]; !ok {
+		return false
+	}
+	if _, ok := s.r_int[p[1]][s.sender]; ok {
+		return false
+	}
+	var cnet net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		cnet = ip4.Mask(net.CIDRMask(24, 32))
+	} else {
+		cnet = ip.Mask(net.CIDRMask(64, 128))
+	}
+	key := cnet.String() + " " + strings.ToLower(s.sender) + " " + strings.ToLower(rcpt)
+	deferred := s.greyDB.check(key, s.Greylist)
+	if deferred {
+		s.Logf("GREYLIST: %s", key)
+	}
+	return deferred
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Listener describes one socket the daemon accepts connections on.
+type Listener struct {
+	Address     string //"host:port", "[::]:port" for dual-stack, or "unix:/path"
+	Mode        string //smtp, submission, smtps or lmtp
+	RequireTLS  bool   //refuse MAIL before STARTTLS
+	RequireAuth bool   //refuse MAIL before AUTH (implied by submission)
+	PlainAuth   bool   //offer AUTH without TLS, e.g. on a loopback listener
+	MaxCli      int    //concurrent clients, defaults to Settings.MaxCli
+}
+
+func (l Listener) String() string {
+	return l.Mode + "@" + l.Address
+}
+
+func (s *Settings) compileListeners() error {
+	if len(s.Listeners) == 0 {
+		addr := net.JoinHostPort(s.Bind, strconv.Itoa(s.Port))
+		s.Listeners = []Listener{{Address: addr, Mode: "smtp"}}
+	}
+	if s.TLSCert != "" || s.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	for i := range s.Listeners {
+		l := &s.Listeners[i]
+		l.Mode = strings.ToLower(l.Mode)
+		switch l.Mode {
+		case "":
+			l.Mode = "smtp"
+		case "smtp", "lmtp":
+		case "submission":
+			l.RequireAuth = true
+		case "smtps":
+			if s.tlsConfig == nil {
+				return fmt.Errorf("listener %s: TLSCert/TLSKey not configured", l)
+			}
+		default:
+			return fmt.Errorf("listener %s: unknown mode", l)
+		}
+		if l.RequireTLS && s.tlsConfig == nil {
+			return fmt.Errorf("listener %s: TLSCert/TLSKey not configured", l)
+		}
+		if l.RequireAuth && len(s.Users) == 0 {
+			return fmt.Errorf("listener %s: AUTH required but no Users configured", l)
+		}
+		if l.RequireAuth && s.tlsConfig == nil && !l.PlainAuth {
+			return fmt.Errorf("listener %s: AUTH required but TLSCert/TLSKey not configured", l)
+		}
+		if l.MaxCli <= 0 {
+			l.MaxCli = s.MaxCli
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package smtp
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// list policy actions
+const (
+	ACT_ACCEPT = "accept"
+	ACT_HOLD   = "hold"
+	ACT_REJECT = "reject"
+)
+
+// reply policies (listPolicy.ReplyTo, also an address)
+const (
+	REPLY_NONE = "none" //leave Reply-To alone
+	REPLY_LIST = "list" //replace Reply-To by the list
+	REPLY_ADD  = "add"  //add the list to Reply-To
+)
+
+// listPolicy holds per-list options.  Settings.Lists is keyed by the list
+// address (e.g. "johns@example.com"), lists not in it use the defaults.
+type listPolicy struct {
+	SPFFail        string   //action for posts failing SPF: accept, hold or reject
+	SPFSoftfail    string   //action for posts with SPF softfail
+	NoDKIM         string   //action for posts without a valid DKIM signature aligned with the sender's domain
+	Name           string   //display name, defaults to the local part of the list address
+	DMARC          string   //for authors with quarantine/reject DMARC policies: munge (From) or wrap
+	MungeTo        string   //where the author of a munged post goes: Reply-To (default) or Cc
+	AllowTypes     []string //media types (e.g. "text/*") of the parts allowed, all if empty
+	DenyTypes      []string //media types of the parts not allowed
+	MaxAttach      int      //bytes an attachment may have (0: no limit)
+	HTMLToText     bool     //convert HTML to plain text, dropping HTML alternatives
+	BadParts       string   //posts with parts not allowed: strip (default, leaving a note) or reject
+	SubjectTag     string   //Subject prefix, e.g. "[johns]"
+	Header         string   //template of text put above the post (see decoration)
+	Footer         string   //template of text put below the post
+	DecorateSigned bool     //add Header and Footer to signed (S/MIME, PGP) posts too
+	ReplyTo        string   //reply policy: none (default), list, add or an address
+	FollowupTo     string   //Mail-Followup-To: left alone (default), list (set to the list) or drop
+	Loop           string   //posts the list distributed before: reject (default) or hold
+	header         *template.Template
+	footer         *template.Template
+}
+
+func (p listPolicy) name(list string) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return list[:strings.Index(list, "@")]
+}
+
+func validAction(act string) bool {
+	return act == "" || act == ACT_ACCEPT || act == ACT_HOLD || act == ACT_REJECT
+}
+
+func (s *Settings) compileLists() error {
+	for addr, p := range s.Lists {
+		if strings.Index(addr, "@") <= 0 {
+			return fmt.Errorf("list %q: expecting list@domain", addr)
+		}
+		if !validAction(p.SPFFail) || !validAction(p.SPFSoftfail) {
+			return fmt.Errorf("list %q: invalid SPF action", addr)
+		}
+		if !validAction(p.NoDKIM) {
+			return fmt.Errorf("list %q: invalid DKIM action", addr)
+		}
+		if p.DMARC != "" && p.DMARC != DMARC_MUNGE && p.DMARC != DMARC_WRAP {
+			return fmt.Errorf("list %q: invalid DMARC mitigation %q", addr, p.DMARC)
+		}
+		switch strings.ToLower(p.MungeTo) {
+		case "", "reply-to", "cc":
+		default:
+			return fmt.Errorf("list %q: invalid MungeTo %q", addr, p.MungeTo)
+		}
+		for _, types := range [][]string{p.AllowTypes, p.DenyTypes} {
+			for i, t := range types {
+				types[i] = strings.ToLower(t)
+				if _, err := path.Match(types[i], ""); err != nil {
+					return fmt.Errorf("list %q: invalid media type %q", addr, t)
+				}
+			}
+		}
+		if p.BadParts != "" && p.BadParts != RULE_STRIP && p.BadParts != ACT_REJECT {
+			return fmt.Errorf("list %q: invalid BadParts %q", addr, p.BadParts)
+		}
+		switch strings.ToLower(p.ReplyTo) {
+		case "", REPLY_NONE, REPLY_LIST, REPLY_ADD:
+		default:
+			if _, err := mail.ParseAddress(p.ReplyTo); err != nil {
+				return fmt.Errorf("list %q: invalid ReplyTo %q", addr, p.ReplyTo)
+			}
+		}
+		if p.Loop != "" && p.Loop != ACT_REJECT && p.Loop != ACT_HOLD {
+			return fmt.Errorf("list %q: invalid Loop action %q", addr, p.Loop)
+		}
+		switch strings.ToLower(p.FollowupTo) {
+		case "", REPLY_LIST, "drop":
+		default:
+			return fmt.Errorf("list %q: invalid FollowupTo %q", addr, p.FollowupTo)
+		}
+		var err error
+		if p.header, err = compileTemplate("header", p.Header); err != nil {
+			return fmt.Errorf("list %q: %v", addr, err)
+		}
+		if p.footer, err = compileTemplate("footer", p.Footer); err != nil {
+			return fmt.Errorf("list %q: %v", addr, err)
+		}
+		s.Lists[addr] = p
+	}
+	return nil
+}
+
+func typeListed(types []string, t string) bool {
+	for _, pat := range types {
+		if ok, _ := path.Match(pat, t); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// badPart tells why the leaf part c is not allowed on the list, or "".
+func (p listPolicy) badPart(c *mimePart) string {
+	if c.parts != nil {
+		return ""
+	}
+	if len(p.AllowTypes) > 0 && !typeListed(p.AllowTypes, c.ctype) || typeListed(p.DenyTypes, c.ctype) {
+		return "type not allowed"
+	}
+	if p.MaxAttach > 0 && c.attachment() && len(c.decoded()) > p.MaxAttach {
+		return fmt.Sprintf("larger than %d bytes", p.MaxAttach)
+	}
+	return ""
+}
+
+// filterMIME applies the MIME policy to mp, replacing parts not allowed by
+// a note, or dropping them from alternatives.  It returns the parts removed.
+func (p listPolicy) filterMIME(mp *mimePart) (removed []string) {
+	changed := p.HTMLToText && mp.htmlToPlain()
+	note := ""
+	drop := func(c *mimePart) bool {
+		why := p.badPart(c)
+		if why != "" {
+			removed = append(removed, c.describe()+": "+why)
+			note = "[Attachment " + c.describe() + " removed: " + why + "]"
+			changed = true
+		}
+		return why != ""
+	}
+	if mp.parts == nil && drop(mp) {
+		mp.replace(note)
+	}
+	mp.walk(func(c *mimePart) {
+		alt := 0
+		if c.ctype == "multipart/alternative" {
+			for _, a := range c.parts {
+				if p.badPart(a) == "" {
+					alt++
+				}
+			}
+		}
+		kept := c.parts[:0]
+		for _, a := range c.parts {
+			if drop(a) {
+				if alt > 0 {
+					continue
+				}
+				a.replace(note)
+			}
+			kept = append(kept, a)
+		}
+		if c.parts != nil {
+			c.parts = kept
+		}
+	})
+	if changed {
+		mp.flatten()
+	}
+	return
+}
+
+// mimePolicy rejects posts with parts not allowed to lists which reject
+// them instead of removing the parts.
+func (s *svrSession) mimePolicy(m *message, rejects map[string]string) {
+	for _, l := range s.rcpts {
+		p, ok := s.Lists[l]
+		if !ok || p.BadParts != ACT_REJECT {
+			continue
+		}
+		tmp := &message{append([]header{}, m.hdrs...), m.body}
+		if removed := p.filterMIME(parseMIME(tmp)); len(removed) > 0 {
+			s.Logf("%s: post from %s to %s rejected, %s", s.CliAddr(), s.sender, l, removed[0])
+			rejects[l] = "554 5.7.1 Not allowed on " + l + ": " + removed[0]
+		}
+	}
+}
+
+// spfPolicy applies the SPF policy of list to the current sender, returning
+// a rejection reply, or "" after marking the list as held if necessary.
+func (s *svrSession) spfPolicy(list string) string {
+	p, ok := s.Lists[list]
+	if !ok {
+		return ""
+	}
+	act := ""
+	switch s.spf {
+	case SPF_FAIL:
+		act = p.SPFFail
+	case SPF_SOFTFAIL:
+		act = p.SPFSoftfail
+	}
+	switch act {
+	case ACT_REJECT:
+		s.Logf("%s: SPF %s (%s), post from %s to %s rejected", s.CliAddr(), s.spf, s.spfID, s.sender, list)
+		if s.spfID == "helo" {
+			return "550 SPF check failed (" + s.spf + ") for HELO " + s.helo
+		}
+		return "550 SPF check failed (" + s.spf + ") for " + s.sender
+	case ACT_HOLD:
+		s.hold[list] = "SPF " + s.spf
+	}
+	return ""
+}
+
+// dkimPolicy applies the DKIM policy of list to the message received, which
+// requires its author (From) to be allowed to post to the list, and a valid
+// signature aligned with the author's domain.  The envelope sender, checked
+// by RCPT, is not enough: anyone can use a member's address there.
+func (s *svrSession) dkimPolicy(m *message, list string) string {
+	p, ok := s.Lists[list]
+	if !ok || p.NoDKIM == "" || p.NoDKIM == ACT_ACCEPT {
+		return ""
+	}
+	from := addrSpec(m.get("From"))
+	reason := ""
+	at := strings.LastIndex(list, "@")
+	switch {
+	case from == "":
+		reason = "no author address"
+	case !s.senderAllowed(from, list[:at], list[at+1:]):
+		reason = "author not allowed to post"
+	case !dkimAligned(s.dkim, from[strings.LastIndex(from, "@")+1:]):
+		reason = "no aligned DKIM signature"
+	default:
+		return ""
+	}
+	if p.NoDKIM == ACT_REJECT {
+		s.Logf("%s: %s, post from %s (%s) to %s rejected", s.CliAddr(), reason, s.sender, from, list)
+		return "550 5.7.1 Post refused (" + reason + ")"
+	}
+	s.hold[list] = reason
+	return ""
+}
+
+// rewrite applies the policy of list to a copy of the message received,
+// before it is distributed to the list members.
+func (s *svrSession) rewrite(m *message, list string) {
+	p := s.Lists[list]
+	for _, r := range p.filterMIME(parseMIME(m)) {
+		s.Debugf("%s>   %s: removed %s", s.CliAddr(), list, r)
+	}
+	if err := s.decorate(m, list, p); err != nil {
+		s.Logf("RUNERR: list %s: %s", list, err.Error())
+	}
+	munged := s.mitigateDMARC(m, list, p)
+	replyPolicy(m, list, p, munged)
+	stamp(m, list, p)
+}
+
+// hasAddr reports whether the address list value contains addr.
+func hasAddr(value, addr string) bool {
+	as, err := mail.ParseAddressList(value)
+	if err != nil {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(addr))
+	}
+	for _, a := range as {
+		if strings.EqualFold(a.Address, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// replyPolicy sets the Reply-To and Mail-Followup-To headers of a post to
+// list.  It runs after DMARC mitigation, which may put the author in
+// Reply-To: the author of a munged post is then kept, as with REPLY_ADD.
+func replyPolicy(m *message, list string, p listPolicy, munged bool) {
+	addr := (&mail.Address{Name: p.name(list), Address: list}).String()
+	var cur []string
+	for _, h := range m.getAll("Reply-To") {
+		cur = append(cur, h.unfolded())
+	}
+	add := munged && !strings.EqualFold(p.MungeTo, "cc")
+	to := ""
+	switch strings.ToLower(p.ReplyTo) {
+	case "", REPLY_NONE:
+	case REPLY_LIST:
+		to = addr
+	case REPLY_ADD:
+		to, add = addr, true
+	default:
+		to = p.ReplyTo
+	}
+	if add && to != "" {
+		if hasAddr(strings.Join(cur, ", "), addrSpec(to)) {
+			to = ""
+		} else {
+			to = strings.Join(append(cur, to), ", ")
+		}
+	}
+	if to != "" {
+		m.remove("Reply-To", func(header) bool { return true })
+		m.insert("Reply-To: " + to)
+	}
+	switch strings.ToLower(p.FollowupTo) {
+	case REPLY_LIST:
+		m.remove("Mail-Followup-To", func(header) bool { return true })
+		m.insert("Mail-Followup-To: " + addr)
+	case "drop":
+		m.remove("Mail-Followup-To", func(header) bool { return true })
+	}
+}
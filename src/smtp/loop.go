@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// listID returns the List-Id of list (RFC2919), e.g. "John's List"
+// <johns.example.com>.
+func listID(list string, p listPolicy) string {
+	name := p.name(list)
+	if isASCII(name) {
+		name = `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+	} else {
+		name = mime.QEncoding.Encode("utf-8", name)
+	}
+	return name + " <" + strings.Replace(strings.ToLower(list), "@", ".", 1) + ">"
+}
+
+// stamp marks a post distributed by list, replacing the List-Id of any
+// upstream list.  X-Loop headers of other lists are kept.
+func stamp(m *message, list string, p listPolicy) {
+	m.remove("List-Id", func(header) bool { return true })
+	m.insert("List-Id: " + listID(list, p))
+	m.insert("X-Loop: " + list)
+}
+
+// looped reports whether m has been distributed by list before.
+func looped(m *message, list string) bool {
+	for _, h := range m.getAll("X-Loop") {
+		if hasAddr(h.unfolded(), list) {
+			return true
+		}
+	}
+	id := "<" + strings.Replace(strings.ToLower(list), "@", ".", 1) + ">"
+	for _, h := range m.getAll("List-Id") {
+		if strings.Contains(strings.ToLower(h.unfolded()), id) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopCheck enforces the hop limit and rejects (or holds) posts to lists
+// which distributed them already.  It returns false if the message is
+// rejected as a whole.
+func (s *svrSession) loopCheck(m *message, rejects map[string]string) bool {
+	if hops := len(m.getAll("Received")); hops > s.MaxHops {
+		s.Logf("%s: LOOP %d hops, message from <%s> rejected", s.CliAddr(), hops, s.sender)
+		for _, l := range s.rcpts {
+			rejects[l] = fmt.Sprintf("554 5.4.6 Too many hops (%d), mail loop?", hops)
+		}
+		s.recipients = make(map[string]string)
+		return false
+	}
+	lists := make(map[string]bool)
+	for _, l := range s.recipients {
+		lists[l] = l != ""
+	}
+	for _, l := range s.rcpts {
+		if !lists[l] || !looped(m, l) {
+			continue
+		}
+		if s.Lists[l].Loop == ACT_HOLD {
+			s.Logf("%s: LOOP post from <%s> to %s held", s.CliAddr(), s.sender, l)
+			s.hold[l] = "mail loop"
+			continue
+		}
+		s.Logf("%s: LOOP post from <%s> to %s rejected", s.CliAddr(), s.sender, l)
+		rejects[l] = "554 5.4.6 Mail loop: already distributed by " + l
+	}
+	return true
+}
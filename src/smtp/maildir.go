@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var maildirSeq int64
+
+// maildirTransport delivers into Maildir folders under a root directory, one
+// folder per local part (e.g. <root>/john/{tmp,new,cur}).
+type maildirTransport string
+
+func maildirHost() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+}
+
+func (t maildirTransport) store(rcpt string, env *envelope, msg *os.File) (perm bool, err error) {
+	local := strings.SplitN(rcpt, "@", 2)[0]
+	if local == "" || strings.HasPrefix(local, ".") || strings.ContainsAny(local, "/\x00") {
+		return true, errors.New("Invalid mailbox name: " + local)
+	}
+	box := path.Join(string(t), local)
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(box+"/"+d, 0700); err != nil {
+			return
+		}
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddInt64(&maildirSeq, 1), maildirHost())
+	tmp := box + "/tmp/" + name
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	_, err = fmt.Fprintf(f, "Return-Path: <%s>\nDelivered-To: %s\n", env.returnPath(), rcpt)
+	if err != nil {
+		return
+	}
+	if _, err = msg.Seek(0, 0); err != nil {
+		return
+	}
+	if _, err = writeUnix(f, msg); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmp, box+"/new/"+name); err != nil {
+		return
+	}
+	if d, e := os.Open(box + "/new"); e == nil {
+		d.Sync()
+		d.Close()
+	}
+	env.Debugf("%s> %s (maildir: %s)", rcpt, path.Base(env.content), name)
+	return
+}
+
+func (t maildirTransport) deliver(env *envelope, msg *os.File) {
+	for _, r := range env.Recipients {
+		perm, err := t.store(r, env, msg)
+		if err != nil {
+			env.recErr(r, err.Error(), perm)
+		}
+	}
+}
@@ -1,8 +1,6 @@
 package smtp
 
 import (
-	"io"
-	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -15,8 +13,8 @@ func fatal(err error) bool {
 	return strings.HasPrefix(err.Error(), "5")
 }
 
-func send(server string, env *envelope, msg *os.File) {
-	cs, err := NewCliSession(server, env)
+func send(server string, lmtp bool, env *envelope, msg *os.File) {
+	cs, err := NewCliSession(server, lmtp, env)
 	defer func() {
 		if cs != nil {
 			cs.Close()
@@ -27,46 +25,48 @@ func send(server string, env *envelope, msg *os.File) {
 		env.recErr("", err.Error(), false)
 		return
 	}
-	err, _ = cs.act("MAIL FROM:<"+env.Origin+">", "2")
+	err, _ = cs.act("MAIL FROM:<"+env.returnPath()+">", "2")
 	if err != nil {
 		env.recErr("", err.Error(), fatal(err))
 		return
 	}
-	rcnt := 0
+	var accepted []string
 	for _, r := range env.Recipients {
 		err, _ = cs.act("RCPT TO:<"+r+">", "2")
 		if err != nil {
 			env.recErr(r, err.Error(), fatal(err))
 			continue
 		}
-		rcnt++
+		accepted = append(accepted, r)
 	}
-	if rcnt > 0 {
+	if len(accepted) > 0 {
 		err, _ = cs.act("DATA", "3")
 		if err != nil {
 			env.recErr("", err.Error(), fatal(err))
 			return
 		}
-		buf := make([]byte, 65536)
-		cnt := 0
-		for {
-			in, err := io.ReadFull(msg, buf)
-			cnt += in
-			if in == 0 {
-				break
+		cnt, err := writeData(cs, msg)
+		if err != nil {
+			env.recErr("", err.Error(), false)
+			return
+		}
+		env.Debugf("%s> %s (%d bytes)", server, path.Base(env.content), cnt)
+		if lmtp { //one reply per accepted recipient (RFC2033, 4.2)
+			cmd := "."
+			for _, r := range accepted {
+				err, _ = cs.act(cmd, "2")
+				if err != nil {
+					env.recErr(r, err.Error(), fatal(err))
+				}
+				cmd = ""
 			}
-			_, err = cs.Write(buf[:in])
+		} else {
+			err, _ = cs.act(".", "2")
 			if err != nil {
-				env.recErr("", err.Error(), false)
+				env.recErr("", err.Error(), fatal(err))
 				return
 			}
 		}
-		env.Debugf("%s> %s (%d bytes)", server, path.Base(env.content), cnt)
-		err, _ = cs.act("\r\n.", "2")
-		if err != nil {
-			env.recErr("", err.Error(), fatal(err))
-			return
-		}
 	}
 	err, _ = cs.act("QUIT", "2")
 	if err != nil {
@@ -87,27 +87,7 @@ func sendMail(file string, ss *Settings) {
 		return
 	}
 	defer msg.Close()
-	var mxs []string
-	if len(ss.Gateways) > 0 {
-		mxs = ss.Gateways
-	} else {
-		mxrs, err := net.LookupMX(env.domain)
-		if err != nil {
-			env.recErr("", err.Error(), true)
-			return
-		}
-		mxs = make([]string, 0, len(mxrs))
-		for _, mxr := range mxrs {
-			mxs = append(mxs, mxr.Host)
-		}
-	}
-	for _, mx := range mxs {
-		if len(env.Recipients) == 0 {
-			break
-		}
-		msg.Seek(0, 0)
-		send(mx, env, msg)
-	}
+	ss.transportFor(env.domain).deliver(env, msg)
 }
 
 func SendMails(spool string, ss *Settings) {
@@ -122,7 +102,7 @@ func SendMails(spool string, ss *Settings) {
 				ts, err := strconv.ParseInt(p[0], 36, 64)
 				if err == nil {
 					if ts+int64(ss.expire) <= time.Now().Unix() {
-						ss.Debugf("SendMail: removing obsolete envelope: " + fn)
+						ss.Debugf("SendMail: removing obsolete envelope: %s", fn)
 						purgeMsg(f, ss)
 					} else {
 						ecnt++
@@ -134,7 +114,7 @@ func SendMails(spool string, ss *Settings) {
 			} else {
 				env, _ := filepath.Glob(f[0:len(f)-4] + "@*.env")
 				if len(env) == 0 {
-					ss.Debugf("SendMail: removing obsolete message: " + fn)
+					ss.Debugf("SendMail: removing obsolete message: %s", fn)
 					purgeMsg(f, ss)
 				}
 			}
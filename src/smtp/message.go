@@ -0,0 +1,207 @@
+package smtp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+)
+
+// header is a header field as found in the message, raw holds the complete
+// field including any folding but without the terminating CRLF.
+type header struct {
+	name string
+	raw  string
+}
+
+func (h header) value() string {
+	return h.raw[len(h.name)+1:]
+}
+
+// unfolded returns the value of the header with folding removed and leading
+// and trailing white space trimmed.
+func (h header) unfolded() string {
+	v := strings.Replace(h.value(), "\r\n", "", -1)
+	return strings.TrimSpace(v)
+}
+
+// message is a spooled message split into its header fields and body.  The
+// spool keeps CRLF line endings, which parseMessage expects.
+type message struct {
+	hdrs []header
+	body []byte
+}
+
+func parseMessage(data []byte) *message {
+	m := &message{}
+	for len(data) > 0 {
+		eol := bytes.Index(data, []byte("\r\n"))
+		if eol < 0 {
+			eol = len(data)
+		}
+		line := string(data[:eol])
+		next := data[eol:]
+		if len(next) > 0 {
+			next = next[2:]
+		}
+		if line == "" {
+			data = next
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(m.hdrs) > 0 {
+			m.hdrs[len(m.hdrs)-1].raw += "\r\n" + line
+			data = next
+			continue
+		}
+		c := strings.Index(line, ":")
+		if c <= 0 || !fieldName(strings.TrimRight(line[:c], " \t")) {
+			break //not a header field, treat the rest as body
+		}
+		m.hdrs = append(m.hdrs, header{line[:c], line})
+		data = next
+	}
+	m.body = data
+	return m
+}
+
+func fieldName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// get returns the unfolded value of the first header named name.
+func (m *message) get(name string) string {
+	for _, h := range m.hdrs {
+		if strings.EqualFold(strings.TrimSpace(h.name), name) {
+			return h.unfolded()
+		}
+	}
+	return ""
+}
+
+// getAll returns all headers named name, from top to bottom.
+func (m *message) getAll(name string) []header {
+	var hs []header
+	for _, h := range m.hdrs {
+		if strings.EqualFold(strings.TrimSpace(h.name), name) {
+			hs = append(hs, h)
+		}
+	}
+	return hs
+}
+
+// remove deletes all headers named name for which drop returns true.
+func (m *message) remove(name string, drop func(h header) bool) {
+	hdrs := m.hdrs[:0]
+	for _, h := range m.hdrs {
+		if !strings.EqualFold(strings.TrimSpace(h.name), name) || !drop(h) {
+			hdrs = append(hdrs, h)
+		}
+	}
+	m.hdrs = hdrs
+}
+
+// prepend adds a header field (e.g. "X-Foo: bar") on top of the message.
+func (m *message) prepend(field string) {
+	c := strings.Index(field, ":")
+	m.hdrs = append([]header{{field[:c], field}}, m.hdrs...)
+}
+
+// insert adds a header field at the bottom of the header.
+func (m *message) insert(field string) {
+	c := strings.Index(field, ":")
+	m.hdrs = append(m.hdrs, header{field[:c], field})
+}
+
+// insertAt adds a header field above the idx-th header (0: on top).
+func (m *message) insertAt(idx int, field string) {
+	if idx < 0 || idx > len(m.hdrs) {
+		idx = len(m.hdrs)
+	}
+	c := strings.Index(field, ":")
+	m.hdrs = append(m.hdrs[:idx], append([]header{{field[:c], field}}, m.hdrs[idx:]...)...)
+}
+
+// change sets the value of the idx-th (from 1) header named name, which is
+// added if missing, or removed if value is empty.
+func (m *message) change(name string, idx int, value string) {
+	for i, h := range m.hdrs {
+		if !strings.EqualFold(strings.TrimSpace(h.name), name) {
+			continue
+		}
+		if idx--; idx > 0 {
+			continue
+		}
+		if value == "" {
+			m.hdrs = append(m.hdrs[:i], m.hdrs[i+1:]...)
+		} else {
+			m.hdrs[i] = header{h.name, h.name + ": " + value}
+		}
+		return
+	}
+	if value != "" {
+		m.insert(name + ": " + value)
+	}
+}
+
+func (m *message) bytes() []byte {
+	var buf bytes.Buffer
+	for _, h := range m.hdrs {
+		buf.WriteString(h.raw + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(m.body)
+	return buf.Bytes()
+}
+
+// addrDomain returns the lower case domain of the first address in an
+// address header value.
+func addrDomain(value string) string {
+	addr := addrSpec(value)
+	return addr[strings.LastIndex(addr, "@")+1:]
+}
+
+// addrSpec returns the (first, lower case) address of an address header
+// value, e.g. From, or "" if it has none.
+func addrSpec(value string) string {
+	addr := value
+	if as, err := mail.ParseAddressList(value); err == nil && len(as) > 0 {
+		addr = as[0].Address
+	} else if lt := strings.Index(value, "<"); lt >= 0 {
+		addr = strings.SplitN(value[lt+1:], ">", 2)[0]
+	}
+	addr = strings.ToLower(strings.Trim(addr, " \t<>"))
+	if !strings.Contains(addr, "@") {
+		return ""
+	}
+	return addr
+}
+
+// load reads the message being received from the spool, which DATA keeps
+// within MaxSize.
+func (s *svrSession) load() (*message, error) {
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(s.file)
+	if err != nil {
+		return nil, err
+	}
+	return parseMessage(data), nil
+}
+
+// save replaces the message being received in the spool with m.
+func (s *svrSession) save(m *message) error {
+	err := s.file.Truncate(0)
+	if err == nil {
+		_, err = s.file.WriteAt(m.bytes(), 0)
+	}
+	if err == nil {
+		_, err = s.file.Seek(0, 2)
+	}
+	return err
+}
@@ -0,0 +1,454 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// milter configures a content filter speaking the Sendmail milter protocol.
+type milter struct {
+	Address  string //"host:port" or "unix:/path"
+	Timeout  int    //seconds to wait for the filter, defaults to 30
+	FailOpen bool   //accept mail if the filter fails, instead of tempfailing it
+}
+
+// milter commands (MTA to filter)
+const (
+	SMFIC_ABORT   = 'A'
+	SMFIC_BODY    = 'B'
+	SMFIC_CONNECT = 'C'
+	SMFIC_MACRO   = 'D'
+	SMFIC_BODYEOB = 'E'
+	SMFIC_HELO    = 'H'
+	SMFIC_HEADER  = 'L'
+	SMFIC_MAIL    = 'M'
+	SMFIC_EOH     = 'N'
+	SMFIC_OPTNEG  = 'O'
+	SMFIC_QUIT    = 'Q'
+	SMFIC_RCPT    = 'R'
+	SMFIC_DATA    = 'T'
+)
+
+// milter replies (filter to MTA)
+const (
+	SMFIR_ADDRCPT     = '+'
+	SMFIR_DELRCPT     = '-'
+	SMFIR_ADDRCPT_PAR = '2'
+	SMFIR_ACCEPT      = 'a'
+	SMFIR_REPLBODY    = 'b'
+	SMFIR_CONTINUE    = 'c'
+	SMFIR_DISCARD     = 'd'
+	SMFIR_CHGFROM     = 'e'
+	SMFIR_ADDHEADER   = 'h'
+	SMFIR_INSHEADER   = 'i'
+	SMFIR_CHGHEADER   = 'm'
+	SMFIR_PROGRESS    = 'p'
+	SMFIR_QUARANTINE  = 'q'
+	SMFIR_REJECT      = 'r'
+	SMFIR_SKIP        = 's'
+	SMFIR_TEMPFAIL    = 't'
+	SMFIR_REPLYCODE   = 'y'
+)
+
+// milter protocol flags: events the filter does not want (SMFIP_NO*), or
+// does not reply to (SMFIP_NR_*)
+const (
+	SMFIP_NOCONNECT = 0x1
+	SMFIP_NOHELO    = 0x2
+	SMFIP_NOMAIL    = 0x4
+	SMFIP_NORCPT    = 0x8
+	SMFIP_NOBODY    = 0x10
+	SMFIP_NOHDRS    = 0x20
+	SMFIP_NOEOH     = 0x40
+	SMFIP_NR_HDR    = 0x80
+	SMFIP_NODATA    = 0x200
+	SMFIP_SKIP      = 0x400
+	SMFIP_NR_CONN   = 0x1000
+	SMFIP_NR_HELO   = 0x2000
+	SMFIP_NR_MAIL   = 0x4000
+	SMFIP_NR_RCPT   = 0x8000
+	SMFIP_NR_DATA   = 0x10000
+	SMFIP_NR_EOH    = 0x40000
+	SMFIP_NR_BODY   = 0x80000
+)
+
+const (
+	milterVersion = 6
+	milterActions = 0xff    //all modifications but SETSYMLIST
+	milterProto   = 0xdf6ff //all NO* and NR_* flags we honour
+	milterChunk   = 65535
+)
+
+const milterTempfail = "451 4.7.1 Service unavailable - try again later"
+
+type milterConn struct {
+	*milter
+	conn     net.Conn
+	proto    uint32
+	failed   bool
+	skipConn bool //accepted the connection, no more events
+	skipMsg  bool //accepted or discarded the message, no more events for it
+}
+
+func (s *Settings) compileMilters() error {
+	for i := range s.Milters {
+		if s.Milters[i].Address == "" || s.Milters[i].Address == "unix:" {
+			return fmt.Errorf("milter #%d: missing address", i+1)
+		}
+		if s.Milters[i].Timeout <= 0 {
+			s.Milters[i].Timeout = 30
+		}
+	}
+	return nil
+}
+
+func (mc *milterConn) send(cmd byte, data []byte) error {
+	pkt := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(pkt, uint32(len(data)+1))
+	pkt[4] = cmd
+	copy(pkt[5:], data)
+	mc.conn.SetDeadline(time.Now().Add(time.Duration(mc.Timeout) * time.Second))
+	_, err := mc.conn.Write(pkt)
+	return err
+}
+
+func (mc *milterConn) recv() (byte, []byte, error) {
+	for {
+		mc.conn.SetDeadline(time.Now().Add(time.Duration(mc.Timeout) * time.Second))
+		var hdr [4]byte
+		if _, err := io.ReadFull(mc.conn, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size == 0 || size > 1<<24 {
+			return 0, nil, fmt.Errorf("invalid packet size %d", size)
+		}
+		pkt := make([]byte, size)
+		if _, err := io.ReadFull(mc.conn, pkt); err != nil {
+			return 0, nil, err
+		}
+		if pkt[0] != SMFIR_PROGRESS {
+			return pkt[0], pkt[1:], nil
+		}
+	}
+}
+
+// event sends an event to the filter and returns its reply, unless it asked
+// not to get the event (no) or not to reply to it (nr).
+func (mc *milterConn) event(cmd byte, data []byte, no, nr uint32) (byte, []byte, error) {
+	if mc.proto&no != 0 {
+		return SMFIR_CONTINUE, nil, nil
+	}
+	if err := mc.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+	if mc.proto&nr != 0 {
+		return SMFIR_CONTINUE, nil, nil
+	}
+	return mc.recv()
+}
+
+func dialMilter(m *milter) (*milterConn, error) {
+	network, address := "tcp", m.Address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", address[5:]
+	}
+	conn, err := net.DialTimeout(network, address, time.Duration(m.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	mc := &milterConn{milter: m, conn: conn}
+	opt := make([]byte, 12)
+	binary.BigEndian.PutUint32(opt, milterVersion)
+	binary.BigEndian.PutUint32(opt[4:], milterActions)
+	binary.BigEndian.PutUint32(opt[8:], milterProto)
+	if err = mc.send(SMFIC_OPTNEG, opt); err == nil {
+		var cmd byte
+		cmd, opt, err = mc.recv()
+		if err == nil && (cmd != SMFIC_OPTNEG || len(opt) < 12) {
+			err = errors.New("option negotiation failed")
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	mc.proto = binary.BigEndian.Uint32(opt[8:]) & milterProto
+	return mc, nil
+}
+
+// cstrings joins strings as NUL terminated strings.
+func cstrings(strs ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range strs {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// milterReply converts the reply of a filter to an SMTP reply, "" to go on.
+func milterReply(code byte, data []byte) string {
+	switch code {
+	case SMFIR_REJECT:
+		return "550 5.7.1 Command rejected"
+	case SMFIR_TEMPFAIL:
+		return milterTempfail
+	case SMFIR_REPLYCODE:
+		return strings.TrimRight(string(data), "\x00")
+	}
+	return ""
+}
+
+// milterFail takes a filter out of service after an error, returning the
+// reply to give if it fails closed.
+func (s *svrSession) milterFail(mc *milterConn, err error) string {
+	s.Logf("MILTER: %s: %s", mc.Address, err.Error())
+	if mc.conn != nil {
+		mc.conn.Close()
+	}
+	mc.failed = true
+	if mc.FailOpen {
+		return ""
+	}
+	return milterTempfail
+}
+
+// milterEvent passes an SMTP event to the filters, returning the reply of
+// the first one refusing it, or "".
+func (s *svrSession) milterEvent(cmd byte, data []byte, no, nr uint32, macros ...string) string {
+	for _, mc := range s.milters {
+		if mc.failed {
+			if !mc.FailOpen {
+				return milterTempfail
+			}
+			continue
+		}
+		if mc.skipConn || mc.skipMsg && cmd != SMFIC_CONNECT && cmd != SMFIC_HELO {
+			continue
+		}
+		var err error
+		if len(macros) > 0 {
+			err = mc.send(SMFIC_MACRO, append([]byte{cmd}, cstrings(macros...)...))
+		}
+		code, rdata := byte(SMFIR_CONTINUE), []byte(nil)
+		if err == nil {
+			code, rdata, err = mc.event(cmd, data, no, nr)
+		}
+		if err != nil {
+			if msg := s.milterFail(mc, err); msg != "" {
+				return msg
+			}
+			continue
+		}
+		switch code {
+		case SMFIR_ACCEPT:
+			if cmd == SMFIC_CONNECT || cmd == SMFIC_HELO {
+				mc.skipConn = true
+			} else {
+				mc.skipMsg = true
+			}
+		case SMFIR_DISCARD:
+			mc.skipMsg = true
+			s.discard = true
+		case SMFIR_REJECT, SMFIR_TEMPFAIL, SMFIR_REPLYCODE:
+			msg := milterReply(code, rdata)
+			s.Logf("%s: MILTER %s refused %c: %s", s.CliAddr(), mc.Address, cmd, msg)
+			return msg
+		}
+	}
+	return ""
+}
+
+// milterConnect connects to the filters and passes them the SMTP connection.
+func (s *svrSession) milterConnect() string {
+	for i := range s.Milters {
+		mc, err := dialMilter(&s.Milters[i])
+		if err != nil {
+			mc = &milterConn{milter: &s.Milters[i]}
+			s.milterFail(mc, err)
+		}
+		s.milters = append(s.milters, mc)
+	}
+	client := s.CliAddr()
+	data := cstrings(client) //unresolved, hostname is the address literal
+	data = append(data, 'U')
+	if ip := s.cliIP(); ip != nil {
+		client = addrLiteral(ip)
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+		port := 0
+		if ta, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+			port = ta.Port
+		}
+		data = append(cstrings(client), family, byte(port>>8), byte(port))
+		data = append(data, cstrings(ip.String())...)
+	}
+	return s.milterEvent(SMFIC_CONNECT, data, SMFIP_NOCONNECT, SMFIP_NR_CONN,
+		"j", s.localDomain(), "{daemon_name}", "mld", "_", client, "{client_addr}", s.CliAddr())
+}
+
+// milterEOM passes the message received to the filters and applies their
+// modifications, returning the reply of the first one refusing it, or "".
+func (s *svrSession) milterEOM(m *message) string {
+	for _, mc := range s.milters {
+		if mc.failed {
+			if !mc.FailOpen {
+				return milterTempfail
+			}
+			continue
+		}
+		if mc.skipConn || mc.skipMsg {
+			mc.skipMsg = false
+			continue
+		}
+		msg, err := s.milterMessage(mc, m)
+		if err != nil {
+			msg = s.milterFail(mc, err)
+		}
+		if msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+func (s *svrSession) milterMessage(mc *milterConn, m *message) (string, error) {
+	reply := func(code byte, data []byte) string {
+		if code == SMFIR_DISCARD {
+			s.discard = true
+		}
+		msg := milterReply(code, data)
+		if msg != "" {
+			s.Logf("%s: MILTER %s refused message: %s", s.CliAddr(), mc.Address, msg)
+		}
+		return msg
+	}
+	for _, h := range m.hdrs {
+		value := strings.Replace(h.value(), "\r\n", "\n", -1)
+		value = strings.TrimPrefix(value, " ")
+		code, data, err := mc.event(SMFIC_HEADER, cstrings(strings.TrimSpace(h.name), value), SMFIP_NOHDRS, SMFIP_NR_HDR)
+		if err != nil || code != SMFIR_CONTINUE {
+			return reply(code, data), err
+		}
+	}
+	code, data, err := mc.event(SMFIC_EOH, nil, SMFIP_NOEOH, SMFIP_NR_EOH)
+	if err != nil || code != SMFIR_CONTINUE {
+		return reply(code, data), err
+	}
+	for body := m.body; len(body) > 0; {
+		n := len(body)
+		if n > milterChunk {
+			n = milterChunk
+		}
+		code, data, err = mc.event(SMFIC_BODY, body[:n], SMFIP_NOBODY, SMFIP_NR_BODY)
+		if code == SMFIR_SKIP {
+			break
+		}
+		if err != nil || code != SMFIR_CONTINUE {
+			return reply(code, data), err
+		}
+		body = body[n:]
+	}
+	if err = mc.send(SMFIC_BODYEOB, nil); err != nil {
+		return "", err
+	}
+	var body []byte
+	for {
+		code, data, err = mc.recv()
+		if err != nil {
+			return "", err
+		}
+		switch code {
+		case SMFIR_ADDHEADER:
+			if p := strings.SplitN(string(data), "\x00", 3); len(p) == 3 {
+				m.insert(p[0] + ": " + crlf(p[1]))
+			}
+		case SMFIR_INSHEADER, SMFIR_CHGHEADER:
+			if len(data) < 4 {
+				return "", errors.New("short header modification")
+			}
+			idx := int(binary.BigEndian.Uint32(data))
+			p := strings.SplitN(string(data[4:]), "\x00", 3)
+			if len(p) < 2 {
+				return "", errors.New("malformed header modification")
+			}
+			if code == SMFIR_INSHEADER {
+				m.insertAt(idx, p[0]+": "+crlf(p[1]))
+			} else {
+				m.change(p[0], idx, crlf(p[1]))
+			}
+		case SMFIR_REPLBODY:
+			body = append(body, data...)
+		case SMFIR_ADDRCPT, SMFIR_ADDRCPT_PAR:
+			_, rcpt := normalize("TO:" + strings.SplitN(string(data), "\x00", 2)[0])
+			s.Debugf("%s>   +%s (MILTER)", s.CliAddr(), rcpt)
+			if msg := s.relay(rcpt); msg != "" {
+				s.Logf("%s: MILTER %s added recipient %s: %s", s.CliAddr(), mc.Address, rcpt, msg)
+			}
+		case SMFIR_DELRCPT:
+			//the milter knows the RCPT addresses only, not their expansion
+			_, rcpt := normalize("TO:" + strings.SplitN(string(data), "\x00", 2)[0])
+			for r, l := range s.recipients {
+				if strings.EqualFold(l, rcpt) || l == "" && strings.EqualFold(r, rcpt) {
+					delete(s.recipients, r)
+				}
+			}
+			var rcpts []string
+			for _, r := range s.rcpts {
+				if !strings.EqualFold(r, rcpt) {
+					rcpts = append(rcpts, r)
+				}
+			}
+			s.rcpts = rcpts
+			s.Debugf("%s>   -%s (MILTER)", s.CliAddr(), rcpt)
+		case SMFIR_CHGFROM:
+			s.sender = strings.Trim(strings.SplitN(string(data), "\x00", 2)[0], "<>")
+		case SMFIR_QUARANTINE:
+			s.quarantine = strings.TrimRight(string(data), "\x00")
+			s.Logf("%s: MILTER %s quarantined message: %s", s.CliAddr(), mc.Address, s.quarantine)
+		case SMFIR_ACCEPT, SMFIR_CONTINUE:
+			if body != nil {
+				m.body = []byte(crlf(string(body)))
+			}
+			return "", nil
+		default:
+			return reply(code, data), nil
+		}
+	}
+}
+
+// crlf normalizes line endings to CRLF.
+func crlf(s string) string {
+	return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// milterAbort tells the filters that the current message is abandoned.
+func (s *svrSession) milterAbort() {
+	for _, mc := range s.milters {
+		mc.skipMsg = false
+		if !mc.failed && !mc.skipConn {
+			if err := mc.send(SMFIC_ABORT, nil); err != nil {
+				s.milterFail(mc, err)
+			}
+		}
+	}
+}
+
+func (s *svrSession) closeMilters() {
+	for _, mc := range s.milters {
+		if !mc.failed {
+			mc.send(SMFIC_QUIT, nil)
+			mc.conn.Close()
+		}
+	}
+	s.milters = nil
+}
@@ -0,0 +1,229 @@
+package smtp
+
+import (
+	"encoding/binary"
+	"io"
+	"log4g"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// syslogSession is testSession for tests whose session logs, which needs
+// syslog.
+func syslogSession(t *testing.T, s *Settings) *svrSession {
+	logger, err := log4g.NewSysLogger("mld-test", false)
+	if err != nil {
+		t.Skip("no syslog:", err)
+	}
+	s.SysLogger = logger
+	return testSession(t, s)
+}
+
+// fakeMilter accepts one filter connection, negotiating proto and answering
+// the other commands with the packets (command byte and data) reply returns.
+// The commands received but macros go to the channel as "<cmd>:<data>", with
+// NULs shown as "|".  It is closed when the MTA hangs up.
+func fakeMilter(t *testing.T, proto uint32, reply func(cmd byte, data string) []string) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 100)
+	go func() {
+		defer close(got)
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		send := func(pkt string) {
+			size := make([]byte, 4)
+			binary.BigEndian.PutUint32(size, uint32(len(pkt)))
+			conn.Write(append(size, pkt...))
+		}
+		for {
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				return
+			}
+			pkt := make([]byte, binary.BigEndian.Uint32(size))
+			if _, err := io.ReadFull(conn, pkt); err != nil {
+				return
+			}
+			cmd, data := pkt[0], string(pkt[1:])
+			if cmd == SMFIC_OPTNEG {
+				opt := make([]byte, 12)
+				binary.BigEndian.PutUint32(opt, milterVersion)
+				binary.BigEndian.PutUint32(opt[4:], milterActions)
+				binary.BigEndian.PutUint32(opt[8:], proto)
+				send("O" + string(opt))
+				continue
+			}
+			if cmd != SMFIC_MACRO {
+				got <- string(cmd) + ":" + strings.Replace(data, "\x00", "|", -1)
+			}
+			for _, r := range reply(cmd, data) {
+				send(r)
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func collect(got chan string) []string {
+	var cmds []string
+	for c := range got {
+		cmds = append(cmds, c)
+	}
+	return cmds
+}
+
+func TestMilterSession(t *testing.T) {
+	addr, got := fakeMilter(t, 0, func(cmd byte, data string) []string {
+		switch cmd {
+		case SMFIC_MACRO, SMFIC_QUIT, SMFIC_ABORT:
+			return nil
+		case SMFIC_RCPT:
+			if strings.HasPrefix(data, "<bad@") {
+				return []string{"y550 5.1.1 No such user\x00"}
+			}
+		case SMFIC_BODYEOB:
+			idx := "\x00\x00\x00\x01"
+			return []string{"pworking", "hX-Filter\x00yes\x00", "m" + idx + "Subject\x00changed\x00",
+				"bnew\nbody\n", "e<new@example.com>\x00", "-<b@example.com>\x00", "c"}
+		}
+		return []string{"c"}
+	})
+	s := syslogSession(t, &Settings{Milters: []milter{{Address: addr, Timeout: 5}}})
+	steps := []struct {
+		reply string
+		event func() string
+	}{
+		{"", s.milterConnect},
+		{"", func() string {
+			return s.milterEvent(SMFIC_HELO, cstrings("client.example"), SMFIP_NOHELO, SMFIP_NR_HELO)
+		}},
+		{"", func() string {
+			return s.milterEvent(SMFIC_MAIL, cstrings("<joe@example.com>"), SMFIP_NOMAIL, SMFIP_NR_MAIL, "{mail_addr}", "joe@example.com")
+		}},
+		{"", func() string {
+			return s.milterEvent(SMFIC_RCPT, cstrings("<a@example.com>"), SMFIP_NORCPT, SMFIP_NR_RCPT)
+		}},
+		{"550 5.1.1 No such user", func() string {
+			return s.milterEvent(SMFIC_RCPT, cstrings("<bad@example.com>"), SMFIP_NORCPT, SMFIP_NR_RCPT)
+		}},
+		{"", func() string {
+			return s.milterEvent(SMFIC_RCPT, cstrings("<b@example.com>"), SMFIP_NORCPT, SMFIP_NR_RCPT)
+		}},
+	}
+	for i, st := range steps {
+		if reply := st.event(); reply != st.reply {
+			t.Fatalf("step %d: %q, want %q", i, reply, st.reply)
+		}
+	}
+	s.sender = "joe@example.com"
+	s.recipients = map[string]string{"a@example.com": "", "b@example.com": ""}
+	s.rcpts = []string{"a@example.com", "b@example.com"}
+	m := parseMessage([]byte("From: joe@example.com\r\nSubject: hi\r\n\r\nbody\r\n"))
+	if reply := s.milterEOM(m); reply != "" {
+		t.Fatalf("end of message: %q", reply)
+	}
+	s.closeMilters()
+	want := []string{"C:local|U", "H:client.example|", "M:<joe@example.com>|", "R:<a@example.com>|",
+		"R:<bad@example.com>|", "R:<b@example.com>|", "L:From|joe@example.com|", "L:Subject|hi|",
+		"N:", "B:body\r\n", "E:", "Q:"}
+	if cmds := collect(got); !reflect.DeepEqual(cmds, want) {
+		t.Errorf("milter got %q\nwant %q", cmds, want)
+	}
+	if out := string(m.bytes()); out != "From: joe@example.com\r\nSubject: changed\r\nX-Filter: yes\r\n\r\nnew\r\nbody\r\n" {
+		t.Errorf("modified message:\n%s", out)
+	}
+	if s.sender != "new@example.com" || !reflect.DeepEqual(s.rcpts, []string{"a@example.com"}) || len(s.recipients) != 1 {
+		t.Errorf("envelope %s => %v, %v", s.sender, s.rcpts, s.recipients)
+	}
+}
+
+func TestMilterProtocolFlags(t *testing.T) {
+	addr, got := fakeMilter(t, SMFIP_NOHELO|SMFIP_NR_MAIL|SMFIP_NOHDRS|SMFIP_NOBODY, func(cmd byte, data string) []string {
+		switch cmd {
+		case SMFIC_CONNECT:
+			return []string{"a"} //accept the connection, nothing more to see
+		case SMFIC_MACRO, SMFIC_MAIL, SMFIC_QUIT:
+			return nil
+		}
+		return []string{"c"}
+	})
+	s := syslogSession(t, &Settings{Milters: []milter{{Address: addr, Timeout: 5}}})
+	s.milterConnect()
+	s.milterEvent(SMFIC_HELO, cstrings("client.example"), SMFIP_NOHELO, SMFIP_NR_HELO)
+	if reply := s.milterEOM(parseMessage([]byte("Subject: hi\r\n\r\nbody\r\n"))); reply != "" {
+		t.Errorf("end of message: %q", reply)
+	}
+	s.closeMilters()
+	if cmds := collect(got); !reflect.DeepEqual(cmds, []string{"C:local|U", "Q:"}) {
+		t.Errorf("after accepting the connection, milter got %q", cmds)
+	}
+
+	addr, got = fakeMilter(t, SMFIP_NOHELO|SMFIP_NR_MAIL|SMFIP_NOHDRS|SMFIP_NOBODY, func(cmd byte, data string) []string {
+		switch cmd {
+		case SMFIC_MACRO, SMFIC_MAIL, SMFIC_QUIT:
+			return nil
+		}
+		return []string{"c"}
+	})
+	s = syslogSession(t, &Settings{Milters: []milter{{Address: addr, Timeout: 5}}})
+	s.milterConnect()
+	s.milterEvent(SMFIC_HELO, cstrings("client.example"), SMFIP_NOHELO, SMFIP_NR_HELO)
+	s.milterEvent(SMFIC_MAIL, cstrings("<joe@example.com>"), SMFIP_NOMAIL, SMFIP_NR_MAIL)
+	if reply := s.milterEOM(parseMessage([]byte("Subject: hi\r\n\r\nbody\r\n"))); reply != "" {
+		t.Errorf("end of message: %q", reply)
+	}
+	s.closeMilters()
+	if cmds := collect(got); !reflect.DeepEqual(cmds, []string{"C:local|U", "M:<joe@example.com>|", "N:", "E:", "Q:"}) {
+		t.Errorf("milter got %q", cmds)
+	}
+}
+
+func TestMilterFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	for _, failOpen := range []bool{false, true} {
+		s := syslogSession(t, &Settings{Milters: []milter{{Address: addr, Timeout: 1, FailOpen: failOpen}}})
+		want := milterTempfail
+		if failOpen {
+			want = ""
+		}
+		if reply := s.milterConnect(); reply != want {
+			t.Errorf("FailOpen %v: connect %q", failOpen, reply)
+		}
+		if reply := s.milterEOM(parseMessage([]byte("Subject: hi\r\n\r\nbody\r\n"))); reply != want {
+			t.Errorf("FailOpen %v: end of message %q", failOpen, reply)
+		}
+	}
+}
+
+func TestMilterReply(t *testing.T) {
+	for _, c := range []struct {
+		code byte
+		data string
+		want string
+	}{
+		{SMFIR_CONTINUE, "", ""},
+		{SMFIR_ACCEPT, "", ""},
+		{SMFIR_DISCARD, "", ""},
+		{SMFIR_REJECT, "", "550 5.7.1 Command rejected"},
+		{SMFIR_TEMPFAIL, "", milterTempfail},
+		{SMFIR_REPLYCODE, "554 5.7.1 Spam\x00", "554 5.7.1 Spam"},
+	} {
+		if got := milterReply(c.code, []byte(c.data)); got != c.want {
+			t.Errorf("%c: %q, want %q", c.code, got, c.want)
+		}
+	}
+}
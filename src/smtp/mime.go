@@ -0,0 +1,255 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+)
+
+const maxMIMEDepth = 16 //nested multiparts parsed
+
+// mimePart is a MIME entity: the message itself or one of its body parts.
+// Multipart bodies are split into parts, which flatten puts back together.
+type mimePart struct {
+	*message
+	ctype    string //lower case media type
+	params   map[string]string
+	parts    []*mimePart //nil unless multipart
+	preamble []byte      //up to the first delimiter line, with its CRLF
+	epilogue []byte      //after the close delimiter line
+}
+
+var crlfBytes = []byte("\r\n")
+
+// parseMIME splits m into its MIME parts.
+func parseMIME(m *message) *mimePart {
+	return parsePart(m, 0)
+}
+
+func parsePart(m *message, depth int) *mimePart {
+	p := &mimePart{message: m, ctype: "text/plain"}
+	if ct := m.get("Content-Type"); ct != "" {
+		if t, params, err := mime.ParseMediaType(ct); err == nil {
+			p.ctype, p.params = t, params
+		}
+	}
+	b := p.params["boundary"]
+	if !strings.HasPrefix(p.ctype, "multipart/") || b == "" || depth >= maxMIMEDepth {
+		return p
+	}
+	delim := []byte("--" + b)
+	body := m.body
+	start := -1 //start of the current part
+	var parts []*mimePart
+	for off := 0; off < len(body); {
+		end := bytes.Index(body[off:], crlfBytes)
+		if end < 0 {
+			end = len(body)
+		} else {
+			end += off
+		}
+		line := body[off:end]
+		next := end + 2
+		if next > len(body) {
+			next = len(body)
+		}
+		if bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t")
+			if len(rest) == 0 || string(rest) == "--" {
+				if start < 0 {
+					p.preamble = body[:off]
+				} else {
+					stop := off - 2 //the CRLF before a delimiter belongs to it
+					if stop < start {
+						stop = start
+					}
+					parts = append(parts, parsePart(parseMessage(body[start:stop]), depth+1))
+				}
+				if len(rest) > 0 {
+					p.epilogue = body[end:]
+					p.parts = parts
+					return p
+				}
+				start = next
+			}
+		}
+		off = next
+	}
+	if start >= 0 { //no close delimiter
+		parts = append(parts, parsePart(parseMessage(body[start:]), depth+1))
+		p.parts = parts
+	}
+	return p
+}
+
+// flatten rebuilds the bodies of multiparts from their parts.
+func (p *mimePart) flatten() {
+	if p.parts == nil {
+		return
+	}
+	b := p.params["boundary"]
+	var buf bytes.Buffer
+	buf.Write(p.preamble)
+	for _, c := range p.parts {
+		c.flatten()
+		buf.WriteString("--" + b + "\r\n")
+		buf.Write(c.bytes())
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + b + "--")
+	buf.Write(p.epilogue)
+	p.body = buf.Bytes()
+}
+
+// walk calls fn for p and its descendants, depth first.
+func (p *mimePart) walk(fn func(*mimePart)) {
+	fn(p)
+	for _, c := range p.parts {
+		c.walk(fn)
+	}
+}
+
+// filename returns the (decoded) file name of an attachment, or "".
+func (p *mimePart) filename() string {
+	name := ""
+	if cd := p.get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil {
+			name = params["filename"]
+		}
+	}
+	if name == "" {
+		name = p.params["name"]
+	}
+	if d, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = d
+	}
+	return name
+}
+
+// decoded returns the body of a leaf part with its transfer encoding undone.
+func (p *mimePart) decoded() []byte {
+	switch strings.ToLower(p.get("Content-Transfer-Encoding")) {
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(reFWS.ReplaceAllString(string(p.body), ""))
+		if err == nil {
+			return data
+		}
+	case "quoted-printable":
+		data, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.body)))
+		if err == nil {
+			return data
+		}
+	}
+	return p.body
+}
+
+// describe returns the file name and media type of a part, for logging.
+func (p *mimePart) describe() string {
+	if fn := p.filename(); fn != "" {
+		return fn + " (" + p.ctype + ")"
+	}
+	return p.ctype
+}
+
+// replace turns p into a text/plain part saying text, keeping its other
+// (e.g. Content-ID) headers.
+func (p *mimePart) replace(text string) {
+	for _, f := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Description"} {
+		p.remove(f, func(header) bool { return true })
+	}
+	p.insert("Content-Type: text/plain; charset=utf-8")
+	p.insert("Content-Transfer-Encoding: 8bit")
+	p.ctype, p.params, p.parts = "text/plain", map[string]string{"charset": "utf-8"}, nil
+	p.preamble, p.epilogue = nil, nil
+	p.body = []byte(text)
+}
+
+// attachment reports whether p is an attachment rather than message text.
+func (p *mimePart) attachment() bool {
+	cd := strings.ToLower(p.get("Content-Disposition"))
+	return strings.HasPrefix(cd, "attachment") || p.filename() != "" || !strings.HasPrefix(p.ctype, "text/")
+}
+
+var (
+	reHTMLDrop  = regexp.MustCompile(`(?is)<!--.*?-->|<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	reHTMLBreak = regexp.MustCompile(`(?i)<br\b[^>]*>|</?(p|div|tr|h[1-6]|ul|ol|table|blockquote|pre)\b[^>]*>`)
+	reHTMLItem  = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	reHTMLTag   = regexp.MustCompile(`(?s)<[^>]*>`)
+	reSpaces    = regexp.MustCompile(`\s+`)
+	reBlanks    = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText renders HTML as plain text, crudely: tags are removed, block
+// elements and line breaks start new lines.
+func htmlToText(src string) string {
+	src = reHTMLDrop.ReplaceAllString(src, "")
+	src = reSpaces.ReplaceAllString(src, " ")
+	src = reHTMLBreak.ReplaceAllString(src, "\n")
+	src = reHTMLItem.ReplaceAllString(src, "\n* ")
+	src = html.UnescapeString(reHTMLTag.ReplaceAllString(src, ""))
+	lines := strings.Split(strings.Replace(src, "\u00a0", " ", -1), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	src = reBlanks.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.Replace(strings.TrimSpace(src), "\n", "\r\n", -1) + "\r\n"
+}
+
+// toText converts a text/html part to text/plain, quoted-printable encoded.
+func (p *mimePart) toText() {
+	charset := p.params["charset"]
+	if charset == "" {
+		charset = "utf-8"
+	}
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(htmlToText(string(p.decoded()))))
+	w.Close()
+	for _, f := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		p.remove(f, func(header) bool { return true })
+	}
+	p.insert("Content-Type: " + mime.FormatMediaType("text/plain", map[string]string{"charset": charset}))
+	p.insert("Content-Transfer-Encoding: quoted-printable")
+	p.ctype, p.params = "text/plain", map[string]string{"charset": charset}
+	p.body = buf.Bytes()
+}
+
+// htmlToPlain drops the HTML alternatives of multipart/alternative parts
+// having a plain text one, and converts other inline HTML to plain text.
+func (p *mimePart) htmlToPlain() bool {
+	changed := false
+	p.walk(func(c *mimePart) {
+		if c.ctype != "multipart/alternative" {
+			return
+		}
+		plain := false
+		for _, a := range c.parts {
+			plain = plain || a.ctype == "text/plain"
+		}
+		if !plain {
+			return
+		}
+		kept := c.parts[:0]
+		for _, a := range c.parts {
+			if a.ctype == "text/html" {
+				changed = true
+			} else {
+				kept = append(kept, a)
+			}
+		}
+		c.parts = kept
+	})
+	p.walk(func(c *mimePart) {
+		if c.parts == nil && c.ctype == "text/html" &&
+			!strings.HasPrefix(strings.ToLower(c.get("Content-Disposition")), "attachment") {
+			c.toText()
+			changed = true
+		}
+	})
+	return changed
+}
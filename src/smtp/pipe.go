@@ -0,0 +1,83 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+const EX_TEMPFAIL = 75 //sysexits.h
+
+// pipeTransport feeds the message to an external command, once per recipient.
+// The command gets SENDER, RECIPIENT and LIST in its environment.  Exit code 0
+// means delivered, EX_TEMPFAIL (or a timeout) means try again later, anything
+// else is a permanent failure.
+type pipeTransport []string
+
+func (t pipeTransport) run(rcpt string, env *envelope, msg *os.File) (perm bool, err error) {
+	if _, err = msg.Seek(0, 0); err != nil {
+		return
+	}
+	timeout := time.Duration(env.PipeTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t[0], t[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SENDER="+env.Sender,
+		"RECIPIENT="+rcpt,
+		"LIST="+env.Lists[rcpt],
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = 5 * time.Second //for children left holding stderr open
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	go func() {
+		writeUnix(stdin, msg)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	if err == exec.ErrWaitDelay && cmd.ProcessState.Success() {
+		err = nil //the command itself succeeded
+	}
+	if err == nil {
+		env.Debugf("%s> %s (pipe: %s)", rcpt, path.Base(env.content), t[0])
+		return
+	}
+	reason := strings.TrimSpace(stderr.String())
+	if len(reason) > 200 {
+		reason = reason[:200]
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return false, fmt.Errorf("%s: timed out after %v", t[0], timeout)
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		code := ee.ExitCode()
+		if reason == "" {
+			reason = ee.Error()
+		}
+		//killed by a signal (code -1), e.g. OOM, is worth another try
+		return code != EX_TEMPFAIL && code != -1, errors.New(t[0] + ": " + reason)
+	}
+	return false, err
+}
+
+func (t pipeTransport) deliver(env *envelope, msg *os.File) {
+	for _, r := range env.Recipients {
+		perm, err := t.run(r, env, msg)
+		if err != nil {
+			env.recErr(r, err.Error(), perm)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver performs the DNS lookups needed for delivery and policy checks.
+// Lookups give up when ctx is done.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// dnsTimeout bounds policy lookups (DKIM keys, DMARC records) done while a
+// client waits.
+const dnsTimeout = 10 * time.Second
+
+type sysResolver struct{}
+
+func (sysResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return net.DefaultResolver.LookupMX(ctx, name)
+}
+
+func (sysResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func (sysResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupTXT(ctx, name)
+}
+
+func (sysResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(ctx, addr)
+}
+
+// fileResolver answers lookups from a static file instead of DNS.  Lines are
+// either hosts-style ("<ip> <name>...") or records ("<name> MX <pref> <host>",
+// "<name> TXT <text>").  MX hosts may carry a port (e.g. "127.0.0.1:2525") so
+// that domains can be pointed at local SMTP sinks.  Names not in the file are
+// reported as not found, the system resolver is never consulted.
+type fileResolver struct {
+	mx    map[string][]*net.MX
+	ip    map[string][]net.IP
+	txt   map[string][]string
+	names map[string][]string
+}
+
+func canonName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func newFileResolver(filename string) (*fileResolver, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fr := &fileResolver{
+		make(map[string][]*net.MX),
+		make(map[string][]net.IP),
+		make(map[string][]string),
+		make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(f)
+	lno := 0
+	for scanner.Scan() {
+		lno++
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			for _, n := range fields[1:] {
+				n = canonName(n)
+				fr.ip[n] = append(fr.ip[n], ip)
+				fr.names[ip.String()] = append(fr.names[ip.String()], n)
+			}
+			continue
+		}
+		name := canonName(fields[0])
+		switch strings.ToUpper(fields[1]) {
+		case "MX":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("%s:%d: expecting <name> MX <pref> <host>", filename, lno)
+			}
+			pref, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid MX preference", filename, lno)
+			}
+			fr.mx[name] = append(fr.mx[name], &net.MX{Host: fields[3], Pref: uint16(pref)})
+		case "TXT":
+			txt := strings.TrimSpace(line[len(fields[0]):])
+			txt = strings.TrimSpace(txt[len(fields[1]):])
+			if uq, err := strconv.Unquote(txt); err == nil {
+				txt = uq
+			}
+			fr.txt[name] = append(fr.txt[name], txt)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown record type %s", filename, lno, fields[1])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, mxs := range fr.mx {
+		sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	}
+	return fr, nil
+}
+
+func (fr *fileResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	n := canonName(name)
+	if mxs, ok := fr.mx[n]; ok {
+		return mxs, nil
+	}
+	if _, ok := fr.ip[n]; ok {
+		return []*net.MX{{Host: n, Pref: 0}}, nil //implicit MX (RFC5321, 5.1)
+	}
+	return nil, notFound(name)
+}
+
+func (fr *fileResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := fr.ip[canonName(host)]; ok {
+		return ips, nil
+	}
+	return nil, notFound(host)
+}
+
+func (fr *fileResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := fr.txt[canonName(name)]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (fr *fileResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip := net.ParseIP(addr)
+	if ip != nil {
+		if names, ok := fr.names[ip.String()]; ok {
+			return names, nil
+		}
+	}
+	return nil, notFound(addr)
+}
@@ -0,0 +1,144 @@
+package smtp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFileResolver(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# test data
+127.0.0.2 mx1.example.com Host.Example.com.
+::1 mx2.example.com
+example.com MX 20 mx2.example.com
+example.com MX 10 127.0.0.1:2525
+example.com TXT "v=spf1 -all"   # comment
+`)
+	f.Close()
+	r, err := newFileResolver(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	mxs, err := r.LookupMX(ctx, "EXAMPLE.com.")
+	if err != nil || len(mxs) != 2 || mxs[0].Host != "127.0.0.1:2525" || mxs[1].Pref != 20 {
+		t.Errorf("LookupMX(example.com) = %v, %v", mxs, err)
+	}
+	mxs, err = r.LookupMX(ctx, "host.example.com")
+	if err != nil || len(mxs) != 1 || mxs[0].Host != "host.example.com" {
+		t.Errorf("LookupMX(host.example.com), implicit MX = %v, %v", mxs, err)
+	}
+	ips, err := r.LookupIP(ctx, "host.example.com")
+	if err != nil || !reflect.DeepEqual(ips, []net.IP{net.ParseIP("127.0.0.2")}) {
+		t.Errorf("LookupIP(host.example.com) = %v, %v", ips, err)
+	}
+	txt, err := r.LookupTXT(ctx, "example.com")
+	if err != nil || !reflect.DeepEqual(txt, []string{"v=spf1 -all"}) {
+		t.Errorf("LookupTXT(example.com) = %q, %v", txt, err)
+	}
+	names, err := r.LookupAddr(ctx, "127.0.0.2")
+	if err != nil || !reflect.DeepEqual(names, []string{"mx1.example.com", "host.example.com"}) {
+		t.Errorf("LookupAddr(127.0.0.2) = %v, %v", names, err)
+	}
+	if _, err = r.LookupIP(ctx, "other.example.com"); err == nil {
+		t.Error("LookupIP(other.example.com) did not fail")
+	} else if de, ok := err.(*net.DNSError); !ok || !de.IsNotFound {
+		t.Errorf("LookupIP(other.example.com) error %v is not a not-found DNSError", err)
+	}
+}
+
+func TestFileResolverErrors(t *testing.T) {
+	for _, data := range []string{
+		"example.com MX 10\n",
+		"example.com MX ten mx.example.com\n",
+		"example.com SRV 0 0 25 mx.example.com\n",
+	} {
+		f, err := ioutil.TempFile("", "hosts")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+		if _, err = newFileResolver(f.Name()); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+		os.Remove(f.Name())
+	}
+}
+
+// noAddrResolver answers every lookup without records nor error.
+type noAddrResolver struct{}
+
+func (noAddrResolver) LookupMX(context.Context, string) ([]*net.MX, error) { return nil, nil }
+func (noAddrResolver) LookupIP(context.Context, string) ([]net.IP, error)  { return nil, nil }
+func (noAddrResolver) LookupTXT(context.Context, string) ([]string, error) { return nil, nil }
+func (noAddrResolver) LookupAddr(context.Context, string) ([]string, error) {
+	return nil, nil
+}
+
+func TestDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	fr := &fileResolver{ip: map[string][]net.IP{
+		"mx.example.com": {net.ParseIP("127.0.0.1")},
+	}}
+	for _, c := range []struct {
+		server string
+		r      Resolver
+		ok     bool
+	}{
+		{ln.Addr().String(), fr, true},
+		{"mx.example.com:" + port, fr, true},
+		{"other.example.com:" + port, fr, false},
+		{"mx.example.com:" + port, noAddrResolver{}, false},
+		{"mx.example.com", fr, false},
+	} {
+		conn, err := dial(c.server, c.r)
+		if conn != nil {
+			conn.Close()
+		}
+		if c.ok && (err != nil || conn == nil) {
+			t.Errorf("dial(%s) = %v, %v", c.server, conn, err)
+		}
+		if !c.ok && (err == nil || conn != nil) {
+			t.Errorf("dial(%s) did not fail", c.server)
+		}
+	}
+}
+
+// testResolver returns a fileResolver answering from data.
+func testResolver(t *testing.T, data string) *fileResolver {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(data)
+	f.Close()
+	r, err := newFileResolver(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
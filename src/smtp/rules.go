@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// rule actions
+const (
+	RULE_REJECT    = "reject"
+	RULE_HOLD      = "hold"
+	RULE_DISCARD   = "discard"
+	RULE_ADDHEADER = "addheader"
+	RULE_STRIP     = "strip"
+)
+
+// rule is an entry of the rules file (Settings.Rules), a JSON array checked
+// in order against each message received.  All conditions given must match.
+type rule struct {
+	ID         string
+	Header     string   //header name, its value matched by Match
+	Match      string   //regular expression, matched against the value(s) of Header
+	Body       string   //regular expression, matched against the decoded text parts
+	Sender     string   //regular expression, matched against the envelope sender
+	List       string   //recipient list address
+	Client     []string //IPs, CIDR blocks or @AccessLists names
+	Attachment string   //media type ("application/*") or file name ("*.exe") pattern
+	Action     string   //reject, hold, discard, addheader or strip (the matching attachments)
+	Reply      string   //reply to rejected messages, e.g. "550 5.7.1 No thanks"
+	AddHeader  string   //header field added, e.g. "X-Spam: yes"
+	match      *regexp.Regexp
+	body       *regexp.Regexp
+	sender     *regexp.Regexp
+	client     ipMatcher
+}
+
+var reReply = regexp.MustCompile(`^[45][0-9][0-9] [^\r\n]*$`)
+
+func (s *Settings) compileRules() error {
+	if s.Rules == "" {
+		return nil
+	}
+	f, err := os.Open(s.Rules)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(&s.rules); err != nil {
+		return fmt.Errorf("%s: %v", s.Rules, err)
+	}
+	ids := make(map[string]bool)
+	for i, r := range s.rules {
+		if r.ID == "" {
+			r.ID = fmt.Sprintf("#%d", i+1)
+		}
+		if ids[r.ID] {
+			return fmt.Errorf("rule %s: duplicate ID", r.ID)
+		}
+		ids[r.ID] = true
+		if err = r.compile(s); err != nil {
+			return fmt.Errorf("rule %s: %v", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *rule) compile(s *Settings) (err error) {
+	if r.Header == "" && r.Body == "" && r.Sender == "" && r.List == "" &&
+		len(r.Client) == 0 && r.Attachment == "" {
+		return fmt.Errorf("no condition")
+	}
+	if r.Match != "" && r.Header == "" {
+		return fmt.Errorf("Match without Header")
+	}
+	for _, re := range []struct {
+		expr string
+		dst  **regexp.Regexp
+	}{{r.Match, &r.match}, {r.Body, &r.body}, {r.Sender, &r.sender}} {
+		if re.expr == "" {
+			continue
+		}
+		if *re.dst, err = regexp.Compile(re.expr); err != nil {
+			return err
+		}
+	}
+	if r.client, err = s.compileACL(r.Client, map[string]bool{}); err != nil {
+		return err
+	}
+	r.List = strings.ToLower(r.List)
+	r.Attachment = strings.ToLower(r.Attachment)
+	if _, err = path.Match(r.Attachment, ""); err != nil {
+		return err
+	}
+	switch r.Action {
+	case RULE_REJECT:
+		if r.Reply == "" {
+			r.Reply = "550 5.7.1 Message rejected by rule " + r.ID
+		}
+		if !reReply.MatchString(r.Reply) {
+			return fmt.Errorf("invalid Reply %q", r.Reply)
+		}
+	case RULE_HOLD, RULE_DISCARD:
+	case RULE_ADDHEADER:
+		if c := strings.Index(r.AddHeader, ":"); c <= 0 || !fieldName(r.AddHeader[:c]) {
+			return fmt.Errorf("invalid AddHeader %q", r.AddHeader)
+		}
+	case RULE_STRIP:
+		if r.Attachment == "" {
+			return fmt.Errorf("strip without Attachment")
+		}
+	default:
+		return fmt.Errorf("invalid action %q", r.Action)
+	}
+	return nil
+}
+
+// attached reports whether p, a leaf part, matches the Attachment pattern.
+func (r *rule) attached(p *mimePart) bool {
+	if p.parts != nil {
+		return false
+	}
+	if strings.Contains(r.Attachment, "/") {
+		ok, _ := path.Match(r.Attachment, p.ctype)
+		return ok
+	}
+	fn := strings.ToLower(p.filename())
+	ok, _ := path.Match(r.Attachment, fn)
+	return fn != "" && ok
+}
+
+// matches checks the conditions of r against the current transaction and
+// message m (with its MIME structure mp).
+func (s *svrSession) matches(r *rule, m *message, mp *mimePart) bool {
+	if len(r.Client) > 0 && !r.client.match(s.cliIP()) {
+		return false
+	}
+	if r.sender != nil && !r.sender.MatchString(s.sender) {
+		return false
+	}
+	if r.List != "" {
+		found := false
+		for _, l := range s.recipients {
+			found = found || l == r.List
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.Header != "" {
+		found := false
+		for _, h := range m.getAll(r.Header) {
+			found = found || r.match == nil || r.match.MatchString(h.unfolded())
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.body != nil {
+		found := false
+		mp.walk(func(p *mimePart) {
+			if !found && p.parts == nil && strings.HasPrefix(p.ctype, "text/") {
+				found = r.body.Match(p.decoded())
+			}
+		})
+		if !found {
+			return false
+		}
+	}
+	if r.Attachment != "" {
+		found := false
+		mp.walk(func(p *mimePart) { found = found || r.attached(p) })
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRules runs the rules against m, adding rejected recipients to
+// rejects.  It returns false if the message is no longer to be delivered.
+func (s *svrSession) applyRules(m *message, rejects map[string]string) bool {
+	mp := parseMIME(m)
+	for _, r := range s.rules {
+		if !s.matches(r, m, mp) {
+			continue
+		}
+		s.Logf("%s: RULE %s hit, %s message from <%s>", s.CliAddr(), r.ID, r.Action, s.sender)
+		switch r.Action {
+		case RULE_REJECT:
+			if r.List != "" {
+				rejects[r.List] = r.Reply
+				continue
+			}
+			for _, l := range s.rcpts {
+				rejects[l] = r.Reply
+			}
+			s.recipients = make(map[string]string)
+			return false
+		case RULE_HOLD:
+			if r.List != "" {
+				s.hold[r.List] = "rule " + r.ID
+			} else {
+				s.quarantine = "rule " + r.ID
+			}
+		case RULE_DISCARD:
+			for rcpt, l := range s.recipients {
+				if r.List == "" || l == r.List {
+					delete(s.recipients, rcpt)
+				}
+			}
+			if len(s.recipients) == 0 {
+				return false
+			}
+		case RULE_ADDHEADER:
+			m.insert(r.AddHeader)
+		case RULE_STRIP:
+			mp.walk(func(p *mimePart) {
+				if r.attached(p) {
+					s.Debugf("%s>   rule %s: removed %s", s.CliAddr(), r.ID, p.describe())
+					p.replace("[Attachment " + p.describe() + " removed]")
+				}
+			})
+			mp.flatten()
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rulesSettings returns settings with the rules file holding rules compiled.
+func rulesSettings(t *testing.T, rules string) (*Settings, error) {
+	f, err := ioutil.TempFile("", "rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(rules)
+	f.Close()
+	s := &Settings{Rules: f.Name(), AccessLists: map[string][]string{"lan": {"192.168.0.0/16"}}}
+	return s, s.compileRules()
+}
+
+const testRules = `[
+	{"ID": "spam", "Header": "X-Spam-Flag", "Match": "(?i)^yes$", "Action": "reject", "Reply": "550 5.7.1 Spam"},
+	{"ID": "lan", "Client": ["@lan"], "Action": "discard"},
+	{"ID": "exe", "Attachment": "*.exe", "Action": "strip"},
+	{"ID": "pills", "Body": "(?i)v1agra", "List": "List@example.com", "Action": "hold"},
+	{"ID": "bulk", "Sender": "@bulk\\.example$", "List": "list@example.com", "Action": "discard"},
+	{"Header": "Subject", "Action": "addheader", "AddHeader": "X-Checked: yes"},
+	{"ID": "other", "List": "other@example.com", "Sender": "^spammer@", "Action": "reject"},
+	{"ID": "quarantine", "Attachment": "application/x-msdownload", "Action": "hold"}
+]`
+
+func TestApplyRules(t *testing.T) {
+	plain := "From: joe@example.org\r\nSubject: hi\r\n\r\nbody\r\n"
+	attached := "From: joe@example.org\r\nSubject: hi\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nbuy V1AGRA\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"Run.EXE\"\r\n\r\nMZ\r\n--b--\r\n"
+	both := map[string]string{"a@example.com": "list@example.com", "b@example.com": "other@example.com"}
+	for _, c := range []struct {
+		name       string
+		sender     string
+		msg        string
+		keep       bool
+		rejects    map[string]string
+		rcpts      int //recipients left
+		hold       map[string]string
+		quarantine string
+		want       []string //substrings of the result
+	}{
+		{"clean", "joe@example.org", plain, true, map[string]string{}, 2, map[string]string{}, "", []string{"X-Checked: yes\r\n"}},
+		{"no subject", "joe@example.org", "From: joe@example.org\r\n\r\nbody\r\n", true, map[string]string{}, 2, map[string]string{}, "", nil},
+		{"spam", "joe@example.org", "X-Spam-Flag: YES\r\n" + plain, false,
+			map[string]string{"list@example.com": "550 5.7.1 Spam", "other@example.com": "550 5.7.1 Spam"}, 0, map[string]string{}, "", nil},
+		{"not spam", "joe@example.org", "X-Spam-Flag: no\r\n" + plain, true, map[string]string{}, 2, map[string]string{}, "", nil},
+		{"attachment", "joe@example.org", attached, true, map[string]string{}, 2,
+			map[string]string{"list@example.com": "rule pills"}, "", []string{"[Attachment Run.EXE (application/octet-stream) removed]", "X-Checked: yes\r\n"}},
+		{"bulk", "news@bulk.example", plain, true, map[string]string{}, 1, map[string]string{}, "", nil},
+		{"spammer", "spammer@example.org", plain, true, map[string]string{"other@example.com": "550 5.7.1 Message rejected by rule other"}, 2, map[string]string{}, "", nil},
+	} {
+		s, err := rulesSettings(t, testRules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := syslogSession(t, s)
+		ss.sender, ss.hold = c.sender, map[string]string{}
+		ss.recipients = map[string]string{}
+		for r, l := range both {
+			ss.recipients[r] = l
+		}
+		ss.rcpts = []string{"list@example.com", "other@example.com"}
+		m := parseMessage([]byte(c.msg))
+		rejects := map[string]string{}
+		keep := ss.applyRules(m, rejects)
+		if keep != c.keep || !reflect.DeepEqual(rejects, c.rejects) || len(ss.recipients) != c.rcpts ||
+			!reflect.DeepEqual(ss.hold, c.hold) || ss.quarantine != c.quarantine {
+			t.Errorf("%s: keep %v, rejects %v, %d recipients, hold %v, quarantine %q",
+				c.name, keep, rejects, len(ss.recipients), ss.hold, ss.quarantine)
+		}
+		out := string(m.bytes())
+		for _, w := range c.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%s: %q not in:\n%s", c.name, w, out)
+			}
+		}
+		if strings.Contains(out, "MZ") {
+			t.Errorf("%s: attachment not stripped:\n%s", c.name, out)
+		}
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	s, err := rulesSettings(t, testRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rules) != 8 || s.rules[5].ID != "#6" || s.rules[3].List != "list@example.com" {
+		t.Errorf("rules compiled: %d, IDs %s %s", len(s.rules), s.rules[3].ID, s.rules[5].ID)
+	}
+	for _, bad := range []string{
+		`[{"Action": "reject"}]`,
+		`[{"Match": "x", "Action": "reject"}]`,
+		`[{"Header": "Subject", "Match": "(", "Action": "reject"}]`,
+		`[{"Header": "Subject", "Action": "reject", "Reply": "250 OK"}]`,
+		`[{"Header": "Subject", "Action": "strip"}]`,
+		`[{"Header": "Subject", "Action": "addheader", "AddHeader": "no colon"}]`,
+		`[{"Header": "Subject", "Action": "delete"}]`,
+		`[{"Attachment": "[", "Action": "strip"}]`,
+		`[{"Client": ["@nowhere"], "Action": "hold"}]`,
+		`[{"ID": "x", "Header": "Subject", "Action": "hold"}, {"ID": "x", "Header": "From", "Action": "hold"}]`,
+		`{"Header": "Subject"}`,
+	} {
+		if _, err := rulesSettings(t, bad); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
@@ -2,12 +2,18 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +23,7 @@ const (
 	PROC_QUEUED = iota //add mail to queue
 	PROC_SUBMIT        //confirm relay of queue (move inbound to outbound)
 	PROC_FLUSH         //discard queued mail for this svrSession
+	PROC_REJECT        //discard the mail just received
 )
 
 func newMsgId() string {
@@ -47,17 +54,54 @@ func normalize(addr string) (string, string) {
 	return cmd, addr
 }
 
+// mailSize returns the SIZE parameter of MAIL (RFC1870), or 0.
+func mailSize(param string) int {
+	if gt := strings.Index(param, ">"); gt >= 0 {
+		for _, p := range strings.Fields(param[gt+1:]) {
+			if strings.HasPrefix(strings.ToUpper(p), "SIZE=") {
+				n, _ := strconv.Atoi(p[5:])
+				return n
+			}
+		}
+	}
+	return 0
+}
+
 type svrSession struct {
 	conn       net.Conn
+	lsnr       *Listener
+	lmtp       bool
+	helo       string //HELO/EHLO/LHLO name
+	esmtp      bool
+	tls        bool   //TLS is active
+	starttls   bool   //switch to TLS after the current reply
+	auth       string //authenticated user
+	authCont   func(string) string
 	path       string
 	state      byte
 	seq        int
 	sender     string
-	recipients map[string]byte
+	recipients map[string]string //recipient => list (RCPT address)
+	rcpts      []string          //accepted RCPT addresses, in order
 	file       *os.File
 	data       int
-	p_errs     byte //protocol errors (e.g. syntex error, command out-of-order)
-	r_errs     byte //relay errors
+	inHdr      bool              //in header section, while fixing up headers
+	hdrs       map[string]bool   //header names seen
+	spf        string            //SPF result of MAIL FROM or HELO
+	spfID      string            //identity the SPF result is for: helo or mailfrom
+	spfHdr     string            //Received-SPF header(s)
+	hold       map[string]string //list => reason for holding the message
+	dkim       []dkimResult      //DKIM results of the message received
+	dmarc      *dmarcResult      //DMARC result of the message received
+	arc        *arcResult        //ARC chain validation of the message received
+	authRes    string            //our Authentication-Results, for ARC sealing
+	milters    []*milterConn     //content filters
+	discard    bool              //a filter discarded the message
+	quarantine string            //reason a filter quarantined the message
+	score      int               //DNSBL score
+	listed     map[string]bool   //DNSBL listings already scored
+	p_errs     byte              //protocol errors (e.g. syntex error, command out-of-order)
+	r_errs     byte              //relay errors
 	*Settings
 }
 
@@ -67,6 +111,9 @@ func (s svrSession) expects() (reply string) {
 	switch s.state {
 	case 1:
 		cmds = "EHLO, HELO"
+		if s.lmtp {
+			cmds = "LHLO"
+		}
 	case 2:
 		cmds = "MAIL"
 	default:
@@ -80,7 +127,7 @@ func (s svrSession) expects() (reply string) {
 	return
 }
 
-func (s svrSession) expnList(ctrl map[string][]string, list []string, name string) {
+func (s svrSession) expnList(ctrl map[string][]string, list []string, name string, addr string) {
 	for _, r := range list {
 		if r == name {
 			s.Log("CFGERR: Cyclic recipient name: " + r)
@@ -88,12 +135,12 @@ func (s svrSession) expnList(ctrl map[string][]string, list []string, name strin
 			at := strings.Index(r, "@")
 			if at > 0 && at < len(r)-1 {
 				s.Debugf("%s>   =>%s", s.CliAddr(), r)
-				s.recipients[r] = 1
+				s.recipients[r] = addr
 			} else {
 				expn, ok := ctrl[r]
 				if ok {
 					s.Debugf("%s>   =>[%s, %d addr(s)]", s.CliAddr(), r, len(expn))
-					s.expnList(ctrl, expn, r)
+					s.expnList(ctrl, expn, r, addr)
 				} else {
 					s.Log("CFGERR: Unresolved recpient: " + r)
 				}
@@ -103,14 +150,10 @@ func (s svrSession) expnList(ctrl map[string][]string, list []string, name strin
 }
 
 func (s svrSession) openRelayAllowed() bool {
-	ra := net.ParseIP(strings.Split(s.conn.RemoteAddr().String(), ":")[0])
-	for _, r := range s.OpenRelay {
-		ip := net.ParseIP(r)
-		if ip.Equal(ra) {
-			return true
-		}
+	if s.auth != "" {
+		return true
 	}
-	return false
+	return s.relayACL.match(s.cliIP())
 }
 
 func (s svrSession) senderAllowed(from string, rcpt string, domain string) bool {
@@ -133,32 +176,79 @@ func (s *svrSession) relay(addr string) string {
 	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
 		return "Relay denied (invalid address: " + addr + ")"
 	}
+	if orig, err := s.SRS.reverse(addr); err != nil {
+		s.Logf("%s: SRS %s: %s", s.CliAddr(), addr, err.Error())
+		return "Invalid SRS address (" + err.Error() + ")"
+	} else if orig != addr {
+		s.recipients[orig] = ""
+		s.Debugf("%s>   =>%s (SRS)", s.CliAddr(), orig)
+		return ""
+	}
 	result := "Mailbox not exist or relay denied"
 	ctrl, ok := s.Routing[parts[1]]
 	if ok {
 		expn, ok := ctrl[parts[0]]
 		if ok && s.senderAllowed(s.sender, parts[0], parts[1]) {
-			s.expnList(ctrl, expn, parts[0])
+			s.expnList(ctrl, expn, parts[0], addr)
 			result = ""
 		}
 	} else if s.openRelayAllowed() {
-		s.recipients[addr] = 1
+		s.recipients[addr] = ""
 		s.Debugf("%s>   =>%s (OpenRelay)", s.CliAddr(), addr)
 		result = ""
 	}
 	return result
 }
 
+func (s svrSession) cliIP() net.IP {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return nil //e.g. Unix socket
+	}
+	return net.ParseIP(host)
+}
+
 func (s svrSession) CliAddr() string {
-	addr := s.conn.RemoteAddr().String()
-	if !strings.HasPrefix(addr, "127.0.0.1:") {
-		addr = strings.Split(addr, ":")[0]
+	ip := s.cliIP()
+	if ip == nil {
+		return "local"
 	}
-	return addr
+	if ip.IsLoopback() {
+		return s.conn.RemoteAddr().String()
+	}
+	return ip.String()
 }
 
 func (s svrSession) svrAddr() string {
-	return strings.Split(s.conn.LocalAddr().String(), ":")[0]
+	host, _, err := net.SplitHostPort(s.conn.LocalAddr().String())
+	if err != nil {
+		host = "127.0.0.1"
+	}
+	return host
+}
+
+// received returns the Received header for the current message (RFC5321,
+// 4.4 and RFC3848).
+func (s svrSession) received(by string) string {
+	from := "local"
+	if ip := s.cliIP(); ip != nil {
+		from = addrLiteral(ip)
+	}
+	proto := "SMTP"
+	switch {
+	case s.lmtp:
+		proto = "LMTP"
+	case s.esmtp:
+		proto = "ESMTP"
+		if s.tls {
+			proto += "S"
+		}
+		if s.auth != "" {
+			proto += "A"
+		}
+	}
+	return fmt.Sprintf("Received: from %s (%s) by %s with %s id %x; %s", s.helo, from,
+		by, proto, os.Getpid(), time.Now().Format(time.RFC1123Z))
 }
 
 func (s *svrSession) Reset(reason byte) {
@@ -168,11 +258,27 @@ func (s *svrSession) Reset(reason byte) {
 	}
 	s.state = 2
 	s.sender = ""
-	s.recipients = make(map[string]byte)
+	s.recipients = make(map[string]string)
+	s.rcpts = nil
+	s.spf = ""
+	s.spfID = ""
+	s.spfHdr = ""
+	s.hold = make(map[string]string)
+	s.dkim = nil
+	s.dmarc = nil
+	s.arc = nil
+	s.authRes = ""
+	s.discard = false
+	s.quarantine = ""
+	if reason == PROC_FLUSH || reason == PROC_REJECT {
+		s.milterAbort()
+	}
 	idir := s.Spool + "/inbound/" + s.path + "/"
 	odir := s.Spool + "/outbound/"
 	ls := len(s.Spool + "/inbound/")
 	switch reason {
+	case PROC_QUEUED:
+		s.seq++
 	case PROC_SUBMIT:
 		os.MkdirAll(odir, 0777)
 		dir, err := os.Open(idir)
@@ -184,6 +290,10 @@ func (s *svrSession) Reset(reason byte) {
 			s.Debug("Queueing inbound messages...")
 			envs := 0
 			for _, fn := range msgs {
+				if fn == "hold" {
+					s.submitHeld(idir + "hold/")
+					continue
+				}
 				if strings.HasSuffix(fn, ".env") {
 					envs++
 				}
@@ -201,6 +311,35 @@ func (s *svrSession) Reset(reason byte) {
 		}
 	case PROC_FLUSH:
 		os.RemoveAll(s.Spool + "/inbound/" + s.path)
+	case PROC_REJECT:
+		for _, pat := range []string{"%d.msg", "%d@*", "%d-*", "hold/%d.msg", "hold/%d@*", "hold/%d-*"} {
+			fs, _ := filepath.Glob(idir + fmt.Sprintf(pat, s.seq))
+			for _, fn := range fs {
+				os.Remove(fn)
+			}
+		}
+		s.seq++
+	}
+}
+
+// submitHeld moves held messages to the hold spool, from where they can be
+// released by moving them to the outbound spool.
+func (s *svrSession) submitHeld(dir string) {
+	hdir := s.Spool + "/hold/"
+	msgs, err := filepath.Glob(dir + "*")
+	if err != nil {
+		s.Log("PROC_SUBMIT_HOLD: " + err.Error())
+		return
+	}
+	for _, fi := range msgs {
+		fn := path.Base(fi)
+		if strings.HasSuffix(fn, ".env") {
+			s.Logf("Message held: %s", hdir+s.path+"."+fn)
+		}
+		err = MoveFile(fi, hdir+s.path+"."+fn)
+		if err != nil {
+			s.Logf("PROC_SUBMIT_MOVEFILE(%s): %s", fi, err.Error())
+		}
 	}
 }
 
@@ -210,44 +349,288 @@ func (s *svrSession) prep() error {
 	if err != nil {
 		return err
 	}
-	domains := make(map[string][]string)
-	for r, _ := range s.recipients {
-		p := strings.SplitN(r, "@", 2)
-		domains[p[1]] = append(domains[p[1]], r)
+	s.inHdr = s.lsnr.Mode == "submission"
+	s.hdrs = make(map[string]bool)
+	s.file, err = os.Create(fmt.Sprintf("%s/%d.msg", inbound, s.seq))
+	if err == nil && s.spfHdr != "" {
+		_, err = s.file.Write([]byte(s.spfHdr + "\r\n"))
+	}
+	if err == nil {
+		_, err = s.file.Write([]byte(s.received(s.localDomain()) + "\r\n"))
 	}
-	fromDomain := "[127.0.0.1]"
+	s.data = 0
+	return err
+}
+
+func (s svrSession) localDomain() string {
+	domains := make([]string, 0, len(s.Routing))
 	for domain, _ := range s.Routing {
-		fromDomain = domain
-		break
+		domains = append(domains, domain)
 	}
-	for d, u := range domains {
-		file, err := os.Create(fmt.Sprintf("%s/%d@%s@0.env", inbound, s.seq, d))
-		if err != nil {
+	if len(domains) == 0 {
+		return addrLiteral(net.ParseIP(s.svrAddr()))
+	}
+	sort.Strings(domains)
+	return domains[0]
+}
+
+func (s *svrSession) writeEnv(dir string, stem string, domain string, env *envelope) error {
+	file, err := os.Create(fmt.Sprintf("%s/%s@%s@0.env", dir, stem, domain))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(env)
+}
+
+// inspect checks the message received, possibly modifying it, and returns
+// the rejection replies of lists whose policies refuse it.
+func (s *svrSession) inspect() (map[string]string, error) {
+	rejects := make(map[string]string)
+	trusted := s.lmtp || s.openRelayAllowed()
+	m, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if !s.loopCheck(m, rejects) {
+		return rejects, nil
+	}
+	if !trusted {
+		s.checkAuth(m, rejects)
+	}
+	msg := ""
+	if s.ClamAV.Address != "" {
+		msg = s.virusScan(m)
+	}
+	if msg == "" {
+		msg = s.milterEOM(m)
+	}
+	if msg != "" {
+		for _, l := range s.rcpts {
+			rejects[l] = msg
+		}
+		s.recipients = make(map[string]string)
+		return rejects, nil
+	}
+	if s.discard {
+		s.Logf("%s: MILTER discarded message from <%s>", s.CliAddr(), s.sender)
+		s.recipients = make(map[string]string)
+		return rejects, nil
+	}
+	if !s.applyRules(m, rejects) {
+		return rejects, nil
+	}
+	s.mimePolicy(m, rejects)
+	return rejects, s.save(m)
+}
+
+// checkAuth verifies the DKIM, DMARC and ARC status of m, recording it in
+// an Authentication-Results header, and applies the DKIM policy of the lists.
+func (s *svrSession) checkAuth(m *message, rejects map[string]string) {
+	s.dkim = s.verifyDKIM(m)
+	for _, r := range s.dkim {
+		s.Debugf("%s>   %s", s.CliAddr(), r)
+	}
+	s.dmarc = s.evalDMARC(m)
+	s.Debugf("%s>   %s", s.CliAddr(), s.dmarc)
+	s.arc = s.arcChain(m)
+	s.Debugf("%s>   %s", s.CliAddr(), s.arc)
+	s.authResults(m)
+	for _, l := range s.rcpts {
+		if msg := s.dkimPolicy(m, l); msg != "" {
+			rejects[l] = msg
+		}
+	}
+}
+
+// variant is a version of the message received, as rewritten for some lists.
+type variant struct {
+	stem  string   //file name without extension
+	msg   *message //message content
+	lists []string //lists receiving this version ("" for non-list recipients)
+}
+
+// queue rewrites and signs the message received for each list, and writes
+// the envelopes, one per message version and destination domain.  Each list
+// gets a version of its own, as rewriting stamps its List-Id, and non-list
+// recipients get the message as received.  Recipients of lists that hold the
+// message go to the hold directory, with their own copy of the message, to be
+// submitted to the hold spool.
+func (s *svrSession) queue() error {
+	inbound := s.Spool + "/inbound/" + s.path
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	rcpts := make(map[string][]string)
+	for r, l := range s.recipients {
+		rcpts[l] = append(rcpts[l], r)
+	}
+	var lists []string
+	for l, _ := range rcpts {
+		lists = append(lists, l)
+	}
+	sort.Strings(lists)
+	raw := m.bytes()
+	variants := []*variant{{stem: fmt.Sprint(s.seq), msg: m}}
+	versions := make(map[string]*variant)
+	for _, l := range lists {
+		v := variants[0]
+		if l == "" && s.SRS.Secret != "" && len(lists) > 1 {
+			//forwarded with another sender, so their envelopes are separate
+			v = &variant{stem: fmt.Sprintf("%d-%d", s.seq, len(variants)), msg: parseMessage(raw)}
+			variants = append(variants, v)
+		} else if l != "" {
+			vm := parseMessage(raw)
+			s.rewrite(vm, l)
+			if !bytes.Equal(vm.bytes(), raw) {
+				v = &variant{stem: fmt.Sprintf("%d-%d", s.seq, len(variants)), msg: vm}
+				variants = append(variants, v)
+			}
+		}
+		v.lists = append(v.lists, l)
+		versions[l] = v
+	}
+	for _, v := range variants {
+		domains := []string{addrDomain(v.msg.get("From"))}
+		for _, l := range v.lists {
+			domains = append(domains, l[strings.LastIndex(l, "@")+1:])
+		}
+		if err = s.dkimSign(v.msg, domains...); err != nil {
 			return err
 		}
-		defer file.Close()
-		env := envelope{
-			Sender:     s.sender,
-			Recipients: u,
-			Attempted:  0,
-			Origin:     "postmaster@" + fromDomain,
+		if s.arc == nil {
+			continue
 		}
-		enc := json.NewEncoder(file)
-		if err = enc.Encode(&env); err != nil {
+		if err = s.arcSeal(v.msg, s.arc, s.authRes, domains[1:]...); err != nil {
 			return err
 		}
 	}
-	s.file, err = os.Create(fmt.Sprintf("%s/%d.msg", inbound, s.seq))
-	if err == nil {
-		rcvd := fmt.Sprintf("Received: from %s by %s with SMTP id %x; %v", strings.Split(s.CliAddr(), ":")[0], fromDomain, os.Getpid(), time.Now())
-		_, err = s.file.Write([]byte(rcvd))
+	type envKey struct {
+		stem   string
+		domain string
+		held   bool
+	}
+	envs := make(map[envKey]*envelope)
+	var keys []envKey
+	origin := "postmaster@" + s.localDomain()
+	for _, l := range lists {
+		reason, held := s.hold[l]
+		held = held && l != ""
+		why := l + ": " + reason
+		if s.quarantine != "" {
+			held, why = true, "quarantined: "+s.quarantine
+		}
+		sort.Strings(rcpts[l])
+		for _, r := range rcpts[l] {
+			k := envKey{versions[l].stem, r[strings.LastIndex(r, "@")+1:], held}
+			env := envs[k]
+			if env == nil {
+				env = &envelope{Sender: s.sender, Origin: origin}
+				//our own users' mail is sent, not forwarded
+				_, local := s.Routing[s.sender[strings.LastIndex(s.sender, "@")+1:]]
+				if fwd := s.SRS.forward(s.sender); l == "" && !local && fwd != s.sender {
+					env.SRS = fwd
+				}
+				envs[k] = env
+				keys = append(keys, k)
+			}
+			env.Recipients = append(env.Recipients, r)
+			if l != "" {
+				if env.Lists == nil {
+					env.Lists = make(map[string]string)
+				}
+				env.Lists[r] = l
+			}
+			if held && !strings.Contains(env.Held, why) {
+				if env.Held != "" {
+					env.Held += "; "
+				}
+				env.Held += why
+			}
+		}
+	}
+	queued := make(map[string]bool)
+	for _, k := range keys {
+		dir := inbound
+		if k.held {
+			dir += "/hold"
+			if err = os.MkdirAll(dir, 0777); err != nil {
+				return err
+			}
+		}
+		if err = s.writeEnv(dir, k.stem, k.domain, envs[k]); err != nil {
+			return err
+		}
+		queued[dir+"/"+k.stem+".msg"] = true
+	}
+	for _, v := range variants {
+		for _, dir := range []string{inbound, inbound + "/hold"} {
+			fn := dir + "/" + v.stem + ".msg"
+			if !queued[fn] {
+				continue
+			}
+			if v == variants[0] && dir == inbound {
+				err = s.save(v.msg)
+			} else {
+				err = ioutil.WriteFile(fn, v.msg.bytes(), 0666)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !queued[inbound+"/"+variants[0].stem+".msg"] {
+		return os.Remove(inbound + "/" + variants[0].stem + ".msg")
 	}
-	s.data = 0
 	return nil
 }
 
+func (s svrSession) ehlo(extended bool) string {
+	if !extended {
+		return "250 At your service"
+	}
+	exts := []string{"At your service"}
+	exts = append(exts, "SIZE "+strconv.Itoa(s.MaxSize))
+	if s.tlsConfig != nil && !s.tls && !s.lmtp {
+		exts = append(exts, "STARTTLS")
+	}
+	if len(s.Users) > 0 && !s.lmtp && s.auth == "" && (s.tls || s.lsnr.PlainAuth) {
+		exts = append(exts, "AUTH PLAIN LOGIN")
+	}
+	for i := range exts {
+		if i < len(exts)-1 {
+			exts[i] = "250-" + exts[i]
+		} else {
+			exts[i] = "250 " + exts[i]
+		}
+	}
+	return strings.Join(exts, "\r\n")
+}
+
+// fixup adds the Date and Message-ID headers missing from a message received
+// on a submission listener (RFC6409, 8).
+func (s *svrSession) fixup() {
+	s.inHdr = false
+	if !s.hdrs["date"] {
+		s.file.Write([]byte("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n"))
+	}
+	if !s.hdrs["message-id"] {
+		domain := s.sender[strings.LastIndex(s.sender, "@")+1:]
+		if domain == "" {
+			domain, _ = os.Hostname()
+		}
+		s.file.Write([]byte("Message-ID: <" + newMsgId() + "@" + domain + ">\r\n"))
+	}
+}
+
 func (s *svrSession) handle(cmdline []byte) string {
 	cmdstr := string(cmdline)
+	if s.authCont != nil {
+		cont := s.authCont
+		s.authCont = nil
+		return cont(cmdstr)
+	}
 	if s.state < 4 {
 		chunks := strings.SplitN(cmdstr, " ", 2)
 		cmd := strings.ToUpper(chunks[0])
@@ -255,11 +638,52 @@ func (s *svrSession) handle(cmdline []byte) string {
 		if len(chunks) > 1 {
 			param = chunks[1]
 		}
-		s.Debug(s.CliAddr() + "> " + cmdstr)
+		if cmd == "AUTH" && strings.Contains(strings.TrimSpace(param), " ") {
+			s.Debug(s.CliAddr() + "> AUTH " + strings.Fields(param)[0] + " ****")
+		} else {
+			s.Debug(s.CliAddr() + "> " + cmdstr)
+		}
 		switch cmd {
 		case "EHLO", "HELO":
+			if s.lmtp {
+				s.p_errs++
+				return "500 Syntax error, expecting LHLO"
+			}
+			s.helo = strings.TrimSpace(param)
+			if msg := s.dnsbl("helo", s.helo); msg != "" {
+				s.r_errs++
+				return "550 HELO " + msg
+			}
+			if msg := s.milterEvent(SMFIC_HELO, cstrings(s.helo), SMFIP_NOHELO, SMFIP_NR_HELO); msg != "" {
+				return msg
+			}
 			s.state = 2
-			return "250 At your service"
+			s.esmtp = cmd == "EHLO"
+			return s.ehlo(s.esmtp)
+		case "LHLO":
+			if !s.lmtp {
+				s.p_errs++
+				return "502 Command not implemented"
+			}
+			s.helo = strings.TrimSpace(param)
+			if msg := s.milterEvent(SMFIC_HELO, cstrings(s.helo), SMFIP_NOHELO, SMFIP_NR_HELO); msg != "" {
+				return msg
+			}
+			s.state = 2
+			return s.ehlo(true)
+		case "STARTTLS":
+			if s.tlsConfig == nil || s.lmtp {
+				s.p_errs++
+				return "502 Command not implemented"
+			}
+			if s.tls || s.state != 2 {
+				s.p_errs++
+				return "503 Bad sequence of commands"
+			}
+			s.starttls = true
+			return "220 Ready to start TLS"
+		case "AUTH":
+			return s.authCmd(param)
 		case "DATA":
 			if s.state < 3 {
 				s.p_errs++
@@ -267,6 +691,10 @@ func (s *svrSession) handle(cmdline []byte) string {
 			}
 			err := s.prep()
 			if err == nil {
+				if msg := s.milterEvent(SMFIC_DATA, nil, SMFIP_NODATA, SMFIP_NR_DATA); msg != "" {
+					s.Reset(PROC_REJECT)
+					return msg
+				}
 				s.state = 4
 				return "354 Go ahead"
 			}
@@ -278,9 +706,38 @@ func (s *svrSession) handle(cmdline []byte) string {
 				s.p_errs++
 				return s.expects()
 			}
+			if s.lsnr.RequireTLS && !s.tls {
+				return "530 Must issue a STARTTLS command first"
+			}
+			if s.lsnr.RequireAuth && s.auth == "" {
+				return "530 Authentication required"
+			}
 			cmd, addr := normalize(param)
 			if cmd == "FROM" {
 				s.Debugf("%s>   =[%s]", s.CliAddr(), addr)
+				if mailSize(param) > s.MaxSize {
+					return "552 5.3.4 Message size exceeds fixed maximum message size"
+				}
+				if s.auth == "" && !s.openRelayAllowed() {
+					if msg := s.throttleMsg(s.conn.RemoteAddr()); msg != "" {
+						return msg
+					}
+				}
+				if msg := s.dnsbl("sender", addr[strings.LastIndex(addr, "@")+1:]); msg != "" {
+					s.r_errs++
+					return "550 Sender " + msg
+				}
+				if ip := s.cliIP(); ip != nil && !s.lmtp && !s.openRelayAllowed() {
+					s.spf, s.spfID, s.spfHdr = s.checkSPF(ip, addr, s.helo, s.localDomain())
+					s.Debugf("%s>   SPF=%s (%s)", s.CliAddr(), s.spf, s.spfID)
+				}
+				macros := []string{"i", fmt.Sprintf("%s.%d", s.path, s.seq), "{mail_addr}", addr}
+				if s.auth != "" {
+					macros = append(macros, "{auth_authen}", s.auth)
+				}
+				if msg := s.milterEvent(SMFIC_MAIL, cstrings("<"+addr+">"), SMFIP_NOMAIL, SMFIP_NR_MAIL, macros...); msg != "" {
+					return msg
+				}
 				s.sender = addr
 				s.state = 3
 				return "250 OK"
@@ -298,10 +755,38 @@ func (s *svrSession) handle(cmdline []byte) string {
 			cmd, addr := normalize(param)
 			if cmd == "TO" {
 				s.Debugf("%s>   =[%s]", s.CliAddr(), addr)
+				trusted := s.auth != "" || s.openRelayAllowed()
+				if !trusted {
+					if msg := s.throttleRcpt(s.conn.RemoteAddr()); msg != "" {
+						return msg
+					}
+				}
+				if s.greylisted(addr) {
+					return "451 Greylisted, please try again later"
+				}
+				if msg := s.spfPolicy(addr); msg != "" {
+					s.r_errs++
+					return msg
+				}
+				var saved map[string]string
+				if len(s.milters) > 0 {
+					saved = make(map[string]string)
+					for r, l := range s.recipients {
+						saved[r] = l
+					}
+				}
 				if msg := s.relay(addr); len(msg) > 0 {
 					s.r_errs++
 					return "553 " + msg
 				}
+				if msg := s.milterEvent(SMFIC_RCPT, cstrings("<"+addr+">"), SMFIP_NORCPT, SMFIP_NR_RCPT, "{rcpt_addr}", addr); msg != "" {
+					s.recipients = saved
+					return msg
+				}
+				if !trusted {
+					s.countRcpt(s.conn.RemoteAddr())
+				}
+				s.rcpts = append(s.rcpts, addr)
 				return "250 OK"
 			} else {
 				s.p_errs++
@@ -321,24 +806,105 @@ func (s *svrSession) handle(cmdline []byte) string {
 	} else {
 		s.data += len(cmdstr)
 		if cmdstr == "." {
+			if s.data > s.MaxSize {
+				s.Logf("%s: message from <%s> too large (%d bytes)", s.CliAddr(), s.sender, s.data)
+				n := len(s.rcpts)
+				s.Reset(PROC_REJECT)
+				if !s.lmtp {
+					n = 1
+				}
+				return strings.TrimSuffix(strings.Repeat("552 5.3.4 Message size exceeds fixed maximum message size\r\n", n), "\r\n")
+			}
+			if s.inHdr {
+				s.fixup()
+			}
 			caddr := s.CliAddr()
 			s.Debugf("%s> Received %d bytes", caddr, s.data)
 			s.Debugf("%s> Message queued for %d recipients: ", caddr, len(s.recipients))
 			for r, _ := range s.recipients {
 				s.Debugf("%s>   %s", caddr, r)
 			}
-			s.Reset(PROC_QUEUED)
-			return "250 OK"
-		} else {
-			s.file.Write([]byte("\r\n" + cmdstr))
+			rcpts := s.rcpts
+			rejects, err := s.inspect()
+			if err == nil && len(rejects) > 0 && !s.lmtp {
+				s.Reset(PROC_REJECT)
+				for _, r := range rcpts {
+					if msg, ok := rejects[r]; ok {
+						return msg
+					}
+				}
+			}
+			for r, l := range s.recipients {
+				if _, ok := rejects[l]; ok && l != "" {
+					delete(s.recipients, r)
+				}
+			}
+			if err == nil && len(s.recipients) > 0 {
+				err = s.queue()
+			}
+			if err != nil {
+				s.Logf("%s: ERROR! %s", caddr, err.Error())
+				s.Reset(PROC_REJECT)
+				return "451 Requested action aborted: local error in processing"
+			}
+			if len(s.recipients) > 0 {
+				s.Reset(PROC_QUEUED)
+			} else {
+				s.Reset(PROC_REJECT)
+			}
+			if !s.lmtp {
+				return "250 OK"
+			}
+			//LMTP replies once per accepted recipient (RFC2033, 4.2), and
+			//as each reply is a delivery confirmation, the message is
+			//submitted right away instead of waiting for QUIT.
+			s.Reset(PROC_SUBMIT)
+			replies := make([]string, len(rcpts))
+			for i, r := range rcpts {
+				if msg, ok := rejects[r]; ok {
+					replies[i] = msg
+				} else {
+					replies[i] = "250 OK <" + r + ">"
+				}
+			}
+			return strings.Join(replies, "\r\n")
+		} else if s.data <= s.MaxSize {
+			if strings.HasPrefix(cmdstr, ".") {
+				cmdstr = cmdstr[1:] //dot-unstuffing (RFC5321, 4.5.2)
+			}
+			if s.inHdr {
+				if cmdstr == "" {
+					s.fixup()
+				} else if c := strings.Index(cmdstr, ":"); c > 0 && cmdstr[0] != ' ' && cmdstr[0] != '\t' {
+					s.hdrs[strings.ToLower(strings.TrimSpace(cmdstr[:c]))] = true
+				}
+			}
+			s.file.Write([]byte(cmdstr + "\r\n"))
 		}
 	}
 	return ""
 }
 
 func (s *svrSession) Serve() error {
+	defer s.closeMilters()
 	br := bufio.NewReader(s.conn)
-	for {
+	for s.state > 0 {
+		if s.starttls {
+			if br.Buffered() > 0 {
+				return errors.New("Data received ahead of TLS handshake")
+			}
+			conn := tls.Server(s.conn, s.tlsConfig)
+			s.conn.SetDeadline(time.Now().Add(1 * time.Minute))
+			if err := conn.Handshake(); err != nil {
+				return err
+			}
+			s.conn = conn
+			s.tls = true
+			s.starttls = false
+			s.auth = ""
+			s.state = 1
+			br = bufio.NewReader(s.conn)
+		}
 		s.conn.SetDeadline(time.Now().Add(5 * time.Minute))
 		cmd, xl, err := br.ReadLine()
 		if err != nil {
@@ -362,24 +928,67 @@ func (s *svrSession) Serve() error {
 	return nil
 }
 
-func NewSvrSession(conn net.Conn, env *Settings) (*svrSession, error) {
+func NewSvrSession(conn net.Conn, env *Settings, l *Listener) (*svrSession, error) {
 	path := newMsgId()
 	err := os.MkdirAll(env.Spool+"/inbound/"+path, 0777)
 	if err != nil {
 		return nil, err
 	}
+	implicit := l.Mode == "smtps"
+	if implicit {
+		conn = tls.Server(conn, env.tlsConfig)
+	}
 	ss := &svrSession{
 		conn,
+		l,
+		l.Mode == "lmtp",
+		"",       //helo
+		false,    //esmtp
+		implicit, //tls
+		false,    //starttls
+		"",       //auth
+		nil,      //authCont
 		path,
-		1,  //state
-		1,  //seq
-		"", //sender
-		make(map[string]byte), //recipients
-		nil,                   //file
-		0,                     //data
-		0,                     //p_errs
-		0,                     //r_errs
-		env,                   //Settings
+		1,                       //state
+		1,                       //seq
+		"",                      //sender
+		make(map[string]string), //recipients
+		nil,                     //rcpts
+		nil,                     //file
+		0,                       //data
+		false,                   //inHdr
+		nil,                     //hdrs
+		"",                      //spf
+		"",                      //spfID
+		"",                      //spfHdr
+		make(map[string]string), //hold
+		nil,                     //dkim
+		nil,                     //dmarc
+		nil,                     //arc
+		"",                      //authRes
+		nil,                     //milters
+		false,                   //discard
+		"",                      //quarantine
+		0,                       //score
+		make(map[string]bool),   //listed
+		0,                       //p_errs
+		0,                       //r_errs
+		env,                     //Settings
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+	if ip := ss.cliIP(); ip != nil {
+		if msg := ss.dnsbl("ip", ip.String()); msg != "" {
+			ss.state = 0
+			_, err = conn.Write([]byte("554 Service unavailable; client " + msg + "\r\n"))
+			return ss, err
+		}
+	}
+	if len(ss.Milters) > 0 {
+		if msg := ss.milterConnect(); msg != "" {
+			ss.state = 0
+			_, err = conn.Write([]byte(msg + "\r\n"))
+			return ss, err
+		}
 	}
 	_, err = conn.Write([]byte("220 Service ready\r\n"))
 	return ss, err
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log4g"
@@ -12,26 +13,64 @@ import (
 type routes map[string]map[string][]string
 
 type Settings struct {
-	Bind      string
-	Port      int
-	MaxCli    int
-	DebugMode bool
-	Spool     string
-	AuditLog  string
-	OpenRelay []string
-	Routing   routes
-	Gateways  []string
-	Retries   []int
-	SendLock  int
-	fileName  string
-	expire    int
-	r_int     routes //list members (allowed senders)
-	r_ext     routes //recipients opened to outside 
+	Bind         string
+	Port         int
+	MaxCli       int
+	MaxSize      int        //message size limit in bytes (RFC1870)
+	Limits       limits     //per client IP
+	Listeners    []Listener //defaults to a single SMTP listener on Bind:Port
+	TLSCert      string
+	TLSKey       string
+	Users        map[string]string //AUTH credentials, user => bcrypt hash of password
+	DebugMode    bool
+	Spool        string
+	AuditLog     string
+	OpenRelay    []string            //IPs, CIDR blocks or @AccessLists names
+	Allow        []string            //exceptions to Deny
+	Deny         []string            //refused at connect time
+	AccessLists  map[string][]string //named groups of IPs or CIDR blocks
+	Greylist     greylist
+	DNSBL        []blocklist
+	DNSBLTimeout int                   //seconds per query
+	DNSBLReject  int                   //reject clients whose DNSBL score reaches this (0: never)
+	DKIMKeys     map[string]signingKey //domain => DKIM signing and ARC sealing key
+	Milters      []milter              //content filters, in order
+	ClamAV       clamav                //virus scanner
+	Rules        string                //rules file (JSON), checked after the filters
+	Routing      routes
+	Lists        map[string]listPolicy //list address => options
+	MaxHops      int                   //Received headers a message may have (RFC5321, 6.3)
+	Gateways     []string              //relay hosts for domains no Transports pattern matches
+	SRS          srs                   //sender rewriting of forwarded (non-list) mail
+	Resolver     string                //static hosts file used instead of DNS (optional)
+	Transports   map[string]string     //domain pattern => transport: exact, then subdomain, then "*" (not with Gateways)
+	PipeTimeout  int                   //seconds allowed for pipe transport commands
+	Retries      []int
+	SendLock     int
+	fileName     string
+	expire       int
+	r_int        routes //list members (allowed senders)
+	r_ext        routes //recipients opened to outside
+	dns          Resolver
+	transports   map[string]transport
+	tlsConfig    *tls.Config
+	relayACL     ipMatcher
+	allowACL     ipMatcher
+	denyACL      ipMatcher
+	throttle     *throttle
+	greyDB       *greyDB
+	dnsblCache   *dnsblCache
+	signers      map[string]*dkimSigner
+	rules        []*rule
 	*log4g.SysLogger
 }
 
 func (s Settings) Dump() string {
-	return fmt.Sprintf("SMTP@%s:%d, DBG=%v, CFG=%s", s.Bind, s.Port, s.DebugMode, s.fileName)
+	ls := make([]string, 0, len(s.Listeners))
+	for _, l := range s.Listeners {
+		ls = append(ls, l.String())
+	}
+	return fmt.Sprintf("%s, DBG=%v, CFG=%s", strings.Join(ls, ", "), s.DebugMode, s.fileName)
 }
 
 func (s *Settings) compileRoutes() {
@@ -64,21 +103,55 @@ func LoadSettings(filename string) (*Settings, error) {
 		return nil, err
 	}
 	s := Settings{
-		"127.0.0.1",       //Bind
-		25,                //Port
-		1,                 //MaxCli
-		false,             //DebugMode
-		"/var/spool/mail", //Spool
-		"/var/log/mld",    //AuditLog
-		[]string{},        //OpenRelay
-		routes{},          //Routing
-		[]string{},        //Gateways
-		[]int{},           //Retries
-		3600,              //SendLock
+		"127.0.0.1",             //Bind
+		25,                      //Port
+		1,                       //MaxCli
+		10485760,                //MaxSize
+		limits{},                //Limits
+		nil,                     //Listeners
+		"",                      //TLSCert
+		"",                      //TLSKey
+		map[string]string{},     //Users
+		false,                   //DebugMode
+		"/var/spool/mail",       //Spool
+		"/var/log/mld",          //AuditLog
+		[]string{},              //OpenRelay
+		[]string{},              //Allow
+		[]string{},              //Deny
+		map[string][]string{},   //AccessLists
+		greylist{},              //Greylist
+		[]blocklist{},           //DNSBL
+		5,                       //DNSBLTimeout
+		0,                       //DNSBLReject
+		map[string]signingKey{}, //DKIMKeys
+		[]milter{},              //Milters
+		clamav{},                //ClamAV
+		"",                      //Rules
+		routes{},                //Routing
+		map[string]listPolicy{}, //Lists
+		100,                     //MaxHops
+		[]string{},              //Gateways
+		srs{},                   //SRS
+		"",                      //Resolver
+		map[string]string{},     //Transports
+		60,                      //PipeTimeout
+		[]int{},                 //Retries
+		3600,                    //SendLock
 		filename,
 		0,        //expire
 		routes{}, //r_int
 		routes{}, //r_ext
+		sysResolver{},
+		map[string]transport{},
+		nil, //tlsConfig
+		nil, //relayACL
+		nil, //allowACL
+		nil, //denyACL
+		&throttle{hosts: make(map[string]*hostStats)},
+		nil, //greyDB
+		&dnsblCache{entries: make(map[string]dnsblResult)},
+		map[string]*dkimSigner{},
+		nil, //rules
 		logger,
 	}
 	var f *os.File
@@ -115,6 +188,9 @@ func LoadSettings(filename string) (*Settings, error) {
 		if err == nil {
 			err = os.MkdirAll(s.Spool+"/outbound", 0755)
 		}
+		if err == nil {
+			err = os.MkdirAll(s.Spool+"/hold", 0755)
+		}
 		if err == nil && s.AuditLog != "" {
 			s.AuditLog = path.Clean(s.AuditLog)
 			err = os.MkdirAll(s.AuditLog, 0755)
@@ -124,6 +200,18 @@ func LoadSettings(filename string) (*Settings, error) {
 		if s.MaxCli <= 0 {
 			s.MaxCli = 1
 		}
+		if s.MaxSize <= 0 {
+			s.MaxSize = 10485760
+		}
+		if s.PipeTimeout <= 0 {
+			s.PipeTimeout = 60
+		}
+		if s.MaxHops <= 0 {
+			s.MaxHops = 100
+		}
+		if s.DNSBLTimeout <= 0 {
+			s.DNSBLTimeout = 5
+		}
 		if s.SendLock < 3600 {
 			s.SendLock = 3600
 		}
@@ -139,6 +227,42 @@ func LoadSettings(filename string) (*Settings, error) {
 			s.expire = 3600
 		}
 		s.compileRoutes()
+		if s.Resolver != "" {
+			s.dns, err = newFileResolver(s.Resolver)
+		}
+		if err == nil {
+			err = s.compileTransports()
+		}
+		if err == nil {
+			err = s.compileUsers()
+		}
+		if err == nil {
+			err = s.compileListeners()
+		}
+		if err == nil {
+			err = s.compileACLs()
+		}
+		if err == nil {
+			err = s.compileGreylist()
+		}
+		if err == nil {
+			err = s.compileLists()
+		}
+		if err == nil {
+			err = s.compileDKIM()
+		}
+		if err == nil {
+			err = s.compileSRS()
+		}
+		if err == nil {
+			err = s.compileMilters()
+		}
+		if err == nil {
+			err = s.compileRules()
+		}
+		if err == nil {
+			err = s.compileClamAV()
+		}
 	}
 	return &s, err
 }
@@ -0,0 +1,563 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPF results (RFC7208, 2.6)
+const (
+	SPF_NONE      = "none"
+	SPF_NEUTRAL   = "neutral"
+	SPF_PASS      = "pass"
+	SPF_FAIL      = "fail"
+	SPF_SOFTFAIL  = "softfail"
+	SPF_TEMPERROR = "temperror"
+	SPF_PERMERROR = "permerror"
+)
+
+var errSPFPerm = errors.New("permerror")
+
+// spfTimeout bounds the DNS lookups of one check_host() evaluation, at
+// least 20 seconds (RFC7208, 4.6.4).
+const spfTimeout = 20 * time.Second
+
+// spfCheck evaluates check_host() (RFC7208, 4) for one identity.
+type spfCheck struct {
+	ctx      context.Context //done when the time for the check is up
+	dns      Resolver
+	ip       net.IP
+	sender   string //"local@domain" of the identity being checked
+	helo     string
+	receiver string
+	lookups  int //terms causing DNS queries, at most 10 (RFC7208, 4.6.4)
+	voids    int //lookups with empty answers, at most 2
+	explain  string
+}
+
+func spfDomainValid(d string) bool {
+	d = strings.TrimSuffix(d, ".")
+	if len(d) == 0 || len(d) > 253 || strings.Index(d, ".") < 0 {
+		return false
+	}
+	for _, l := range strings.Split(d, ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func isNotFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && de.IsNotFound
+}
+
+// void classifies the error of a DNS query and counts void lookups.
+func (c *spfCheck) void(err error, empty bool) error {
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if err != nil || empty {
+		c.voids++
+		if c.voids > 2 {
+			return errSPFPerm
+		}
+	}
+	return nil
+}
+
+func (c *spfCheck) count() error {
+	c.lookups++
+	if c.lookups > 10 {
+		return errSPFPerm
+	}
+	return nil
+}
+
+func (c *spfCheck) record(domain string) (string, string) {
+	txts, err := c.dns.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", SPF_NONE
+		}
+		return "", SPF_TEMPERROR
+	}
+	rec := ""
+	for _, t := range txts {
+		lt := strings.ToLower(t)
+		if lt == "v=spf1" || strings.HasPrefix(lt, "v=spf1 ") {
+			if rec != "" {
+				return "", SPF_PERMERROR //multiple records (RFC7208, 4.5)
+			}
+			rec = t
+		}
+	}
+	if rec == "" {
+		return "", SPF_NONE
+	}
+	return rec, ""
+}
+
+// expand performs macro expansion (RFC7208, 7).
+func (c *spfCheck) expand(spec, domain string, exp bool) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i >= len(spec) {
+			return "", errSPFPerm
+		}
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errSPFPerm
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errSPFPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		letter := macro[0]
+		macro = macro[1:]
+		digits := 0
+		for len(macro) > 0 && macro[0] >= '0' && macro[0] <= '9' {
+			digits = digits*10 + int(macro[0]-'0')
+			macro = macro[1:]
+		}
+		reverse := false
+		if len(macro) > 0 && (macro[0] == 'r' || macro[0] == 'R') {
+			reverse = true
+			macro = macro[1:]
+		}
+		delims := "."
+		if len(macro) > 0 {
+			if strings.Trim(macro, ".-+,/_=") != "" {
+				return "", errSPFPerm
+			}
+			delims = macro
+		}
+		local, sdomain := "postmaster", c.sender
+		if at := strings.LastIndex(c.sender, "@"); at >= 0 {
+			if at > 0 {
+				local = c.sender[:at]
+			}
+			sdomain = c.sender[at+1:]
+		}
+		var val string
+		switch letter | 0x20 {
+		case 's':
+			val = local + "@" + sdomain
+		case 'l':
+			val = local
+		case 'o':
+			val = sdomain
+		case 'd':
+			val = domain
+		case 'i':
+			if ip4 := c.ip.To4(); ip4 != nil {
+				val = ip4.String()
+			} else {
+				p := strings.Split(reverseIP(c.ip), ".")
+				for l, r := 0, len(p)-1; l < r; l, r = l+1, r-1 {
+					p[l], p[r] = p[r], p[l]
+				}
+				val = strings.Join(p, ".")
+			}
+		case 'p':
+			val = c.validatedName(domain)
+		case 'v':
+			val = "ip6"
+			if c.ip.To4() != nil {
+				val = "in-addr"
+			}
+		case 'h':
+			val = c.helo
+		case 'c', 'r', 't':
+			if !exp {
+				return "", errSPFPerm
+			}
+			switch letter | 0x20 {
+			case 'c':
+				val = c.ip.String()
+			case 'r':
+				val = c.receiver
+			default:
+				val = strconv.FormatInt(time.Now().Unix(), 10)
+			}
+		default:
+			return "", errSPFPerm
+		}
+		parts := strings.FieldsFunc(val, func(r rune) bool { return strings.ContainsRune(delims, r) })
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		val = strings.Join(parts, ".")
+		if letter >= 'A' && letter <= 'Z' {
+			val = url.QueryEscape(val)
+		}
+		out.WriteString(val)
+	}
+	res := out.String()
+	if !exp {
+		for len(res) > 253 && strings.Index(res, ".") >= 0 {
+			res = res[strings.Index(res, ".")+1:]
+		}
+	}
+	return res, nil
+}
+
+// validatedName returns the validated domain name of the client (RFC7208,
+// 5.5) preferring target or one of its subdomains, or "unknown".
+func (c *spfCheck) validatedName(target string) string {
+	names, err := c.dns.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		return "unknown"
+	}
+	found := ""
+	for i, n := range names {
+		if i >= 10 {
+			break
+		}
+		n = strings.TrimSuffix(n, ".")
+		ips, err := c.dns.LookupIP(c.ctx, n)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(c.ip) {
+				if strings.EqualFold(n, target) || strings.HasSuffix(strings.ToLower(n), "."+strings.ToLower(target)) {
+					return n
+				}
+				if found == "" {
+					found = n
+				}
+			}
+		}
+	}
+	if found == "" {
+		return "unknown"
+	}
+	return found
+}
+
+// splitCIDR splits "domain/cidr4//cidr6" into its parts.
+func splitCIDR(arg string) (string, int, int, error) {
+	c4, c6 := 32, 128
+	if i := strings.Index(arg, "//"); i >= 0 {
+		v, err := strconv.Atoi(arg[i+2:])
+		if err != nil || v < 0 || v > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+		c6 = v
+		arg = arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i >= 0 {
+		v, err := strconv.Atoi(arg[i+1:])
+		if err != nil || v < 0 || v > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+		c4 = v
+		arg = arg[:i]
+	}
+	return arg, c4, c6, nil
+}
+
+func (c *spfCheck) inNet(ip net.IP, c4, c6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		cli4 := c.ip.To4()
+		return cli4 != nil && ip4.Mask(net.CIDRMask(c4, 32)).Equal(cli4.Mask(net.CIDRMask(c4, 32)))
+	}
+	return c.ip.To4() == nil && ip.Mask(net.CIDRMask(c6, 128)).Equal(c.ip.Mask(net.CIDRMask(c6, 128)))
+}
+
+func (c *spfCheck) matchIPs(host string, c4, c6 int) (bool, error) {
+	ips, err := c.dns.LookupIP(c.ctx, host)
+	if err = c.void(err, len(ips) == 0); err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if c.inNet(ip, c4, c6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mechanism evaluates one mechanism, returning whether it matched.
+func (c *spfCheck) mechanism(name, arg string, hasArg bool, domain string, depth int) (bool, error) {
+	target := domain
+	var err error
+	if hasArg && name != "ip4" && name != "ip6" {
+		if arg, err = c.expand(arg, domain, false); err != nil {
+			return false, err
+		}
+	}
+	switch name {
+	case "all":
+		if hasArg {
+			return false, errSPFPerm
+		}
+		return true, nil
+	case "include":
+		if !hasArg || arg == "" {
+			return false, errSPFPerm
+		}
+		if err = c.count(); err != nil {
+			return false, err
+		}
+		switch r, _ := c.checkHost(arg, depth+1); r {
+		case SPF_PASS:
+			return true, nil
+		case SPF_TEMPERROR:
+			return false, errors.New("temperror")
+		case SPF_PERMERROR, SPF_NONE:
+			return false, errSPFPerm
+		}
+		return false, nil
+	case "a", "mx":
+		if err = c.count(); err != nil {
+			return false, err
+		}
+		host, c4, c6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		if host != "" {
+			target = host
+		}
+		if name == "a" {
+			return c.matchIPs(target, c4, c6)
+		}
+		mxs, err := c.dns.LookupMX(c.ctx, target)
+		if err = c.void(err, len(mxs) == 0); err != nil {
+			return false, err
+		}
+		if len(mxs) > 10 {
+			return false, errSPFPerm
+		}
+		for _, mx := range mxs {
+			m, err := c.matchIPs(strings.TrimSuffix(mx.Host, "."), c4, c6)
+			if m || err != nil {
+				return m, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		if err = c.count(); err != nil {
+			return false, err
+		}
+		if hasArg {
+			target = arg
+		}
+		n := c.validatedName(target)
+		return strings.EqualFold(n, target) || strings.HasSuffix(strings.ToLower(n), "."+strings.ToLower(target)), nil
+	case "ip4", "ip6":
+		if !hasArg {
+			return false, errSPFPerm
+		}
+		if strings.Index(arg, "/") < 0 {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		ip, n, err := net.ParseCIDR(arg)
+		if err != nil || (name == "ip4") != (ip.To4() != nil) {
+			return false, errSPFPerm
+		}
+		return n.Contains(c.ip), nil
+	case "exists":
+		if !hasArg || arg == "" {
+			return false, errSPFPerm
+		}
+		if err = c.count(); err != nil {
+			return false, err
+		}
+		ips, err := c.dns.LookupIP(c.ctx, arg)
+		if err = c.void(err, len(ips) == 0); err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, errSPFPerm
+}
+
+func (c *spfCheck) checkHost(domain string, depth int) (string, error) {
+	if depth > 10 || !spfDomainValid(domain) {
+		return SPF_NONE, nil
+	}
+	rec, res := c.record(domain)
+	if res != "" {
+		return res, nil
+	}
+	//modifiers may follow the mechanisms, so they are picked out first
+	redirect, exp := "", ""
+	var mechs []string
+	for _, term := range strings.Fields(rec)[1:] {
+		if eq := strings.Index(term, "="); eq > 0 && strings.Trim(term[:eq], "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_.") == "" {
+			switch strings.ToLower(term[:eq]) {
+			case "redirect":
+				if redirect != "" {
+					return SPF_PERMERROR, nil
+				}
+				redirect = term[eq+1:]
+			case "exp":
+				if exp != "" {
+					return SPF_PERMERROR, nil
+				}
+				exp = term[eq+1:]
+			}
+			continue
+		}
+		mechs = append(mechs, term)
+	}
+	for _, term := range mechs {
+		qual := SPF_PASS
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qual = SPF_FAIL
+			term = term[1:]
+		case '~':
+			qual = SPF_SOFTFAIL
+			term = term[1:]
+		case '?':
+			qual = SPF_NEUTRAL
+			term = term[1:]
+		}
+		name, arg := term, ""
+		sep := strings.IndexAny(term, ":/")
+		hasArg := false
+		if sep >= 0 {
+			name = term[:sep]
+			arg = term[sep:]
+			if arg[0] == ':' {
+				arg = arg[1:]
+				hasArg = true
+			} else {
+				hasArg = name == "a" || name == "mx"
+			}
+		}
+		match, err := c.mechanism(strings.ToLower(name), arg, hasArg, domain, depth)
+		if err == errSPFPerm {
+			return SPF_PERMERROR, nil
+		} else if err != nil {
+			return SPF_TEMPERROR, nil
+		}
+		if match {
+			if qual == SPF_FAIL && exp != "" && depth == 0 {
+				c.explanation(exp, domain)
+			}
+			return qual, nil
+		}
+	}
+	if redirect != "" {
+		if err := c.count(); err != nil {
+			return SPF_PERMERROR, nil
+		}
+		target, err := c.expand(redirect, domain, false)
+		if err != nil {
+			return SPF_PERMERROR, nil
+		}
+		r, err := c.checkHost(target, depth+1)
+		if r == SPF_NONE {
+			r = SPF_PERMERROR
+		}
+		return r, err
+	}
+	return SPF_NEUTRAL, nil
+}
+
+func (c *spfCheck) explanation(exp, domain string) {
+	target, err := c.expand(exp, domain, false)
+	if err != nil {
+		return
+	}
+	txts, err := c.dns.LookupTXT(c.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return
+	}
+	if e, err := c.expand(txts[0], domain, true); err == nil {
+		c.explain = printable(e)
+	}
+}
+
+// checkSPF evaluates the SPF policy of the HELO identity (RFC7208, 2.3) and,
+// unless it is null or the HELO check failed, of the sender for client ip.
+// It returns the result that applies, its identity ("helo" or "mailfrom")
+// and the Received-SPF header fields of the checks done (RFC7208, 9.1).
+func (s *Settings) checkSPF(ip net.IP, sender, helo, receiver string) (result, identity, hdrs string) {
+	//an address literal or a bare name is no HELO identity to check
+	if sender == "" || strings.Contains(helo, ".") && !strings.HasPrefix(helo, "[") {
+		result, hdrs = s.spfIdentity(ip, "helo", "postmaster@"+helo, sender, helo, receiver)
+		if sender == "" || result == SPF_FAIL {
+			return result, "helo", hdrs
+		}
+		hdrs += "\r\n"
+	}
+	result, hdr := s.spfIdentity(ip, "mailfrom", sender, sender, helo, receiver)
+	return result, "mailfrom", hdrs + hdr
+}
+
+// quoted returns s as a quoted-string (RFC5322, 3.2.4).
+func quoted(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// spfIdentity evaluates the SPF policy of id, an address of the given
+// identity, returning the result and the Received-SPF header field.
+func (s *Settings) spfIdentity(ip net.IP, identity, id, sender, helo, receiver string) (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+	defer cancel()
+	c := &spfCheck{ctx: ctx, dns: s.dns, ip: ip, sender: id, helo: helo, receiver: receiver}
+	result, _ := c.checkHost(id[strings.LastIndex(id, "@")+1:], 0)
+	comment := fmt.Sprintf("%s: %s is neither permitted nor denied by domain of %s", receiver, ip, id)
+	switch result {
+	case SPF_PASS:
+		comment = fmt.Sprintf("%s: domain of %s designates %s as permitted sender", receiver, id, ip)
+	case SPF_FAIL, SPF_SOFTFAIL:
+		comment = fmt.Sprintf("%s: domain of %s does not designate %s as permitted sender", receiver, id, ip)
+	case SPF_NONE:
+		comment = fmt.Sprintf("%s: domain of %s does not provide an SPF record", receiver, id)
+	case SPF_TEMPERROR, SPF_PERMERROR:
+		comment = fmt.Sprintf("%s: error in processing during lookup of %s", receiver, id)
+	}
+	if c.explain != "" {
+		comment += ": " + c.explain
+	}
+	hdr := fmt.Sprintf("Received-SPF: %s (%s) client-ip=%s; envelope-from=%s; helo=%s; identity=%s; receiver=%s;",
+		result, comment, ip, quoted(sender), quoted(helo), identity, receiver)
+	return result, hdr
+}
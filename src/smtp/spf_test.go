@@ -0,0 +1,96 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const spfZone = `
+example.com TXT "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a mx/24 include:inc.example.net ~all"
+example.com MX 10 mx.example.com
+198.51.100.1 example.com
+203.0.113.9 mx.example.com
+inc.example.net TXT "v=spf1 ip4:198.51.100.77 -all"
+hard.example.com TXT "v=spf1 -all exp=why.%{d}"
+why.hard.example.com TXT "%{s} may not send from %{i}\r\nX-Injected: yes"
+neutral.example.com TXT "v=spf1 ?all"
+redir.example.com TXT "v=spf1 redirect=inc.example.net"
+macro.example.com TXT "v=spf1 exists:%{ir}.%{l1r-}._spf.%{d} -all"
+127.0.0.2 3.2.0.192.joe._spf.macro.example.com
+ptr.example.com TXT "v=spf1 ptr -all"
+192.0.2.50 host.ptr.example.com
+dup.example.com TXT "v=spf1 -all"
+dup.example.com TXT "v=spf1 +all"
+syntax.example.com TXT "v=spf1 ip4:300.1.1.1 -all"
+loop.example.com TXT "v=spf1 include:loop.example.com -all"
+void.example.com TXT "v=spf1 a:x1.example.com a:x2.example.com a:x3.example.com -all"
+`
+
+func TestSPF(t *testing.T) {
+	s := &Settings{dns: testResolver(t, spfZone)}
+	for _, c := range []struct {
+		ip     string
+		sender string
+		want   string
+	}{
+		{"192.0.2.3", "joe@example.com", SPF_PASS},
+		{"2001:db8::1", "joe@example.com", SPF_PASS},
+		{"198.51.100.1", "joe@example.com", SPF_PASS},
+		{"203.0.113.200", "joe@example.com", SPF_PASS},
+		{"198.51.100.77", "joe@example.com", SPF_PASS},
+		{"10.0.0.1", "joe@example.com", SPF_SOFTFAIL},
+		{"10.0.0.1", "joe@hard.example.com", SPF_FAIL},
+		{"10.0.0.1", "joe@neutral.example.com", SPF_NEUTRAL},
+		{"198.51.100.77", "joe@redir.example.com", SPF_PASS},
+		{"10.0.0.1", "joe@redir.example.com", SPF_FAIL},
+		{"192.0.2.3", "joe-list@macro.example.com", SPF_PASS},
+		{"192.0.2.4", "joe-list@macro.example.com", SPF_FAIL},
+		{"192.0.2.50", "joe@ptr.example.com", SPF_PASS},
+		{"192.0.2.51", "joe@ptr.example.com", SPF_FAIL},
+		{"10.0.0.1", "joe@nospf.example.com", SPF_NONE},
+		{"10.0.0.1", "joe@dup.example.com", SPF_PERMERROR},
+		{"10.0.0.1", "joe@syntax.example.com", SPF_PERMERROR},
+		{"10.0.0.1", "joe@loop.example.com", SPF_PERMERROR},
+		{"10.0.0.1", "joe@void.example.com", SPF_PERMERROR},
+	} {
+		got, hdr := s.spfIdentity(net.ParseIP(c.ip), "mailfrom", c.sender, c.sender, "mail.example.org", "mx.example.net")
+		if got != c.want {
+			t.Errorf("%s from %s: %s, want %s", c.sender, c.ip, got, c.want)
+		}
+		if !strings.HasPrefix(hdr, "Received-SPF: "+c.want+" (mx.example.net: ") ||
+			!strings.Contains(hdr, " client-ip="+c.ip+"; envelope-from=\""+c.sender+"\"; ") {
+			t.Errorf("%s from %s: header %q", c.sender, c.ip, hdr)
+		}
+	}
+}
+
+func TestSPFExplanation(t *testing.T) {
+	s := &Settings{dns: testResolver(t, spfZone)}
+	_, hdr := s.spfIdentity(net.ParseIP("10.0.0.1"), "mailfrom", "joe@hard.example.com", "joe@hard.example.com", "mail.example.org", "mx.example.net")
+	if !strings.Contains(hdr, ": joe@hard.example.com may not send from 10.0.0.1X-Injected: yes)") {
+		t.Errorf("explanation missing from %q", hdr)
+	}
+	if strings.ContainsAny(hdr, "\r\n") {
+		t.Errorf("line break in %q", hdr)
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	s := &Settings{dns: testResolver(t, spfZone)}
+	for _, c := range []struct {
+		sender, helo     string
+		result, identity string
+		headers          int
+	}{
+		{"joe@example.com", "hard.example.com", SPF_FAIL, "helo", 1},
+		{"", "example.com", SPF_SOFTFAIL, "helo", 1},
+		{"joe@example.com", "mail.example.org", SPF_SOFTFAIL, "mailfrom", 2},
+		{"joe@example.com", "[10.0.0.1]", SPF_SOFTFAIL, "mailfrom", 1},
+	} {
+		result, identity, hdrs := s.checkSPF(net.ParseIP("10.0.0.1"), c.sender, c.helo, "mx.example.net")
+		if result != c.result || identity != c.identity || strings.Count(hdrs, "Received-SPF: ") != c.headers {
+			t.Errorf("MAIL FROM %q, HELO %s: %s (%s), headers:\n%s", c.sender, c.helo, result, identity, hdrs)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// srs configures the Sender Rewriting Scheme for forwarded mail.  It is
+// enabled by setting Secret.
+type srs struct {
+	Secret string //HMAC key of the address hashes
+	Domain string //domain of rewritten addresses, defaults to the first Routing domain
+	MaxAge int    //days a rewritten address is valid for bounces
+}
+
+const srsBase32 = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+func (s *Settings) compileSRS() error {
+	if s.SRS.Secret == "" {
+		return nil
+	}
+	if s.SRS.Domain == "" {
+		var domains []string
+		for d, _ := range s.Routing {
+			domains = append(domains, d)
+		}
+		if len(domains) == 0 {
+			return errors.New("SRS: missing Domain")
+		}
+		sort.Strings(domains)
+		s.SRS.Domain = domains[0]
+	}
+	s.SRS.Domain = strings.ToLower(s.SRS.Domain)
+	if s.SRS.MaxAge <= 0 {
+		s.SRS.MaxAge = 21
+	}
+	return nil
+}
+
+func (c srs) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, []byte(c.Secret))
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+// valid checks hash h, ignoring case as some MTAs change that of local parts.
+func (c srs) valid(h string, parts ...string) bool {
+	return hmac.Equal([]byte(strings.ToUpper(h)), []byte(strings.ToUpper(c.hash(parts...))))
+}
+
+// srsDay returns the SRS timestamp: days since the epoch, modulo 1024, in
+// two base32 characters.
+func srsDay(t time.Time) string {
+	d := t.Unix() / 86400
+	return string([]byte{srsBase32[d>>5&31], srsBase32[d&31]})
+}
+
+// forward rewrites sender to an address in the SRS domain.  Null senders and
+// senders in the SRS domain are left alone.  Addresses already rewritten by
+// another forwarder become SRS1 addresses pointing at that forwarder.
+func (c srs) forward(sender string) string {
+	at := strings.LastIndex(sender, "@")
+	if c.Secret == "" || at < 0 {
+		return sender
+	}
+	local, domain := sender[:at], sender[at+1:]
+	if strings.EqualFold(domain, c.Domain) {
+		return sender
+	}
+	tag := strings.ToUpper(local)
+	if len(local) > 5 && strings.ContainsRune("=+-", rune(local[4])) {
+		switch tag[:4] {
+		case "SRS0":
+			rest := local[4:]
+			return fmt.Sprintf("SRS1=%s=%s=%s@%s", c.hash(domain, rest), domain, rest, c.Domain)
+		case "SRS1":
+			p := strings.SplitN(local[5:], "=", 3)
+			if len(p) == 3 && p[1] != "" {
+				rest := p[2]
+				return fmt.Sprintf("SRS1=%s=%s=%s@%s", c.hash(p[1], rest), p[1], rest, c.Domain)
+			}
+		}
+	}
+	ts := srsDay(time.Now())
+	return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", c.hash(ts, domain, local), ts, domain, local, c.Domain)
+}
+
+// reverse returns the address an SRS address of ours was rewritten from, or
+// an error if its hash or timestamp is invalid.  rcpt is returned unchanged
+// if it is not an SRS address.
+func (c srs) reverse(rcpt string) (string, error) {
+	at := strings.LastIndex(rcpt, "@")
+	if c.Secret == "" || at < 0 || !strings.EqualFold(rcpt[at+1:], c.Domain) {
+		return rcpt, nil
+	}
+	local := rcpt[:at]
+	if len(local) < 5 || !strings.ContainsRune("=+-", rune(local[4])) {
+		return rcpt, nil
+	}
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		p := strings.SplitN(local[5:], "=", 4)
+		if len(p) != 4 || len(p[1]) != 2 {
+			return "", errors.New("malformed SRS0 address")
+		}
+		if !c.valid(p[0], p[1], p[2], p[3]) {
+			return "", errors.New("invalid SRS hash")
+		}
+		then := strings.Index(srsBase32, strings.ToUpper(p[1][:1]))<<5 | strings.Index(srsBase32, strings.ToUpper(p[1][1:]))
+		if then < 0 || (int(time.Now().Unix()/86400)-then)&1023 > c.MaxAge {
+			return "", errors.New("expired SRS address")
+		}
+		return p[3] + "@" + p[2], nil
+	case "SRS1":
+		p := strings.SplitN(local[5:], "=", 3)
+		if len(p) != 3 || p[1] == "" {
+			return "", errors.New("malformed SRS1 address")
+		}
+		rest := p[2]
+		if !c.valid(p[0], p[1], rest) {
+			return "", errors.New("invalid SRS hash")
+		}
+		return "SRS0" + rest + "@" + p[1], nil
+	}
+	return rcpt, nil
+}
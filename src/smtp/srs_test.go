@@ -0,0 +1,75 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSRSRoundTrip(t *testing.T) {
+	a := srs{"secret a", "a.example", 21}
+	b := srs{"secret b", "b.example", 21}
+	for _, sender := range []string{"joe@example.com", "Joe.Doe+tag@Example.com", "x=y@example.com"} {
+		fwd := a.forward(sender)
+		if !strings.HasPrefix(fwd, "SRS0=") || !strings.HasSuffix(fwd, "@a.example") {
+			t.Errorf("forward(%s) = %s", sender, fwd)
+		}
+		for _, rcpt := range []string{fwd, strings.ToLower(fwd), strings.ToUpper(fwd[:strings.Index(fwd, "@")]) + "@A.EXAMPLE"} {
+			if orig, err := a.reverse(rcpt); err != nil || !strings.EqualFold(orig, sender) {
+				t.Errorf("reverse(%s) = %s, %v, want %s", rcpt, orig, err, sender)
+			}
+		}
+		//forwarded again: b points bounces at a
+		fwd2 := b.forward(fwd)
+		if !strings.HasPrefix(fwd2, "SRS1=") || !strings.Contains(fwd2, "=a.example==") {
+			t.Errorf("forward(%s) = %s", fwd, fwd2)
+		}
+		if fwd3 := b.forward(strings.Replace(fwd2, "@b.example", "@c.example", 1)); !strings.HasPrefix(fwd3, "SRS1=") || !strings.Contains(fwd3, "=a.example==") {
+			t.Errorf("SRS1 forwarded again: %s", fwd3)
+		}
+		back, err := b.reverse(fwd2)
+		if err != nil || back != fwd {
+			t.Errorf("reverse(%s) = %s, %v, want %s", fwd2, back, err, fwd)
+		}
+		if _, err = a.reverse(strings.Replace(fwd, "@", "x@", 1)); err == nil {
+			t.Errorf("reverse of tampered %s succeeded", fwd)
+		}
+		if _, err = b.reverse(strings.Replace(fwd2, "a.example", "c.example", 1)); err == nil {
+			t.Errorf("reverse of tampered %s succeeded", fwd2)
+		}
+	}
+}
+
+func TestSRSUnchanged(t *testing.T) {
+	c := srs{"secret", "fwd.example", 21}
+	for _, sender := range []string{"", "postmaster", "joe@FWD.example"} {
+		if got := c.forward(sender); got != sender {
+			t.Errorf("forward(%q) = %q", sender, got)
+		}
+	}
+	for _, rcpt := range []string{"joe@example.com", "joe@fwd.example", "SRS0=x@example.com"} {
+		if got, err := c.reverse(rcpt); got != rcpt || err != nil {
+			t.Errorf("reverse(%q) = %q, %v", rcpt, got, err)
+		}
+	}
+	if got := (srs{}).forward("joe@example.com"); got != "joe@example.com" {
+		t.Errorf("forward without secret = %q", got)
+	}
+}
+
+func TestSRSExpiry(t *testing.T) {
+	c := srs{"secret", "fwd.example", 21}
+	for _, age := range []int{0, 21, 22, 1000} {
+		ts := srsDay(time.Now().AddDate(0, 0, -age))
+		rcpt := "SRS0=" + c.hash(ts, "example.com", "joe") + "=" + ts + "=example.com=joe@fwd.example"
+		_, err := c.reverse(rcpt)
+		if (err == nil) != (age <= c.MaxAge) {
+			t.Errorf("%d days old: %v", age, err)
+		}
+	}
+	for _, rcpt := range []string{"SRS0=abcd=AA=example.com@fwd.example", "SRS0=abcd=AAA=example.com=joe@fwd.example", "SRS1=abcd@fwd.example"} {
+		if _, err := c.reverse(rcpt); err == nil {
+			t.Errorf("reverse(%s) succeeded", rcpt)
+		}
+	}
+}
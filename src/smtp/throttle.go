@@ -0,0 +1,165 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// limits are per client IP, 0 means unlimited.  Message and recipient rates
+// do not apply to authenticated and OpenRelay clients.
+type limits struct {
+	Connections int //concurrent connections
+	ConnPerMin  int //new connections per minute
+	MsgPerHour  int //messages (MAIL commands) per hour
+	RcptPerHour int //accepted recipients (RCPT commands) per hour
+}
+
+// window is a sliding window of event times.
+type window []time.Time
+
+// hit records an event unless limit events already happened within span.
+func (w *window) hit(now time.Time, span time.Duration, limit int) bool {
+	if w.full(now, span, limit) {
+		return false
+	}
+	*w = append(*w, now)
+	return true
+}
+
+// full tells whether limit events already happened within span.
+func (w *window) full(now time.Time, span time.Duration, limit int) bool {
+	w.prune(now, span)
+	return limit > 0 && len(*w) >= limit
+}
+
+func (w *window) prune(now time.Time, span time.Duration) {
+	i := 0
+	for i < len(*w) && now.Sub((*w)[i]) >= span {
+		i++
+	}
+	*w = (*w)[i:]
+}
+
+type hostStats struct {
+	conns    int
+	connects window
+	msgs     window
+	rcpts    window
+}
+
+// throttle keeps per-IP statistics shared by all sessions.
+type throttle struct {
+	sync.Mutex
+	hosts map[string]*hostStats
+	swept time.Time
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "" //e.g. Unix socket, not throttled
+	}
+	return host
+}
+
+func (t *throttle) stats(ip string, now time.Time) *hostStats {
+	if now.Sub(t.swept) > time.Minute {
+		for k, h := range t.hosts {
+			h.connects.prune(now, time.Minute)
+			h.msgs.prune(now, time.Hour)
+			h.rcpts.prune(now, time.Hour)
+			if h.conns == 0 && len(h.connects)+len(h.msgs)+len(h.rcpts) == 0 {
+				delete(t.hosts, k)
+			}
+		}
+		t.swept = now
+	}
+	h, ok := t.hosts[ip]
+	if !ok {
+		h = &hostStats{}
+		t.hosts[ip] = h
+	}
+	return h
+}
+
+// Admit registers a new connection from addr.  If it exceeds the per-IP
+// limits, the connection is not registered and a 421 reply is returned.
+func (s *Settings) Admit(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == "" {
+		return ""
+	}
+	s.throttle.Lock()
+	defer s.throttle.Unlock()
+	now := time.Now()
+	h := s.throttle.stats(ip, now)
+	reply := ""
+	if s.Limits.Connections > 0 && h.conns >= s.Limits.Connections {
+		reply = "421 Too many concurrent connections from your host"
+	} else if !h.connects.hit(now, time.Minute, s.Limits.ConnPerMin) {
+		reply = "421 Connection rate limit exceeded, try again later"
+	} else {
+		h.conns++
+		return ""
+	}
+	s.Logf("THROTTLE: %s: %s", ip, reply[4:])
+	return reply
+}
+
+// Release unregisters a connection admitted by Admit.
+func (s *Settings) Release(addr net.Addr) {
+	ip := addrIP(addr)
+	if ip == "" {
+		return
+	}
+	s.throttle.Lock()
+	defer s.throttle.Unlock()
+	if h, ok := s.throttle.hosts[ip]; ok && h.conns > 0 {
+		h.conns--
+	}
+}
+
+// throttleMsg returns a 451 reply if the client may not start another message.
+func (s *Settings) throttleMsg(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == "" || s.Limits.MsgPerHour <= 0 {
+		return ""
+	}
+	s.throttle.Lock()
+	defer s.throttle.Unlock()
+	if s.throttle.stats(ip, time.Now()).msgs.hit(time.Now(), time.Hour, s.Limits.MsgPerHour) {
+		return ""
+	}
+	reply := "451 Message rate limit exceeded, try again later"
+	s.Logf("THROTTLE: %s: %s", ip, reply[4:])
+	return reply
+}
+
+// throttleRcpt returns a 451 reply if the client may not add another recipient.
+// Only accepted recipients count, see countRcpt.
+func (s *Settings) throttleRcpt(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == "" || s.Limits.RcptPerHour <= 0 {
+		return ""
+	}
+	s.throttle.Lock()
+	defer s.throttle.Unlock()
+	if !s.throttle.stats(ip, time.Now()).rcpts.full(time.Now(), time.Hour, s.Limits.RcptPerHour) {
+		return ""
+	}
+	reply := "451 Recipient rate limit exceeded, try again later"
+	s.Logf("THROTTLE: %s: %s", ip, reply[4:])
+	return reply
+}
+
+// countRcpt records a recipient accepted from the client.
+func (s *Settings) countRcpt(addr net.Addr) {
+	ip := addrIP(addr)
+	if ip == "" || s.Limits.RcptPerHour <= 0 {
+		return
+	}
+	s.throttle.Lock()
+	defer s.throttle.Unlock()
+	s.throttle.stats(ip, time.Now()).rcpts.hit(time.Now(), time.Hour, 0)
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// transport delivers the message of an envelope to (some of) its recipients,
+// recording per-recipient results with env.recErr().
+type transport interface {
+	deliver(env *envelope, msg *os.File)
+}
+
+// relayTransport sends to a fixed list of hosts, tried in order.
+type relayTransport []string
+
+func (t relayTransport) deliver(env *envelope, msg *os.File) {
+	for _, host := range t {
+		if len(env.Recipients) == 0 {
+			break
+		}
+		msg.Seek(0, 0)
+		send(host, false, env, msg)
+	}
+}
+
+// lmtpTransport sends to an LMTP server ("host[:port]" or "unix:/path").
+type lmtpTransport string
+
+func (t lmtpTransport) deliver(env *envelope, msg *os.File) {
+	send(string(t), true, env, msg)
+}
+
+// mxTransport sends to the MX hosts of the envelope's domain.
+type mxTransport struct{}
+
+func (mxTransport) deliver(env *envelope, msg *os.File) {
+	mxrs, err := env.dns.LookupMX(context.Background(), env.domain)
+	if err != nil {
+		env.recErr("", err.Error(), true)
+		return
+	}
+	mxs := make(relayTransport, 0, len(mxrs))
+	for _, mxr := range mxrs {
+		mxs = append(mxs, mxr.Host)
+	}
+	mxs.deliver(env, msg)
+}
+
+// parseTransport parses a transport specification:
+//
+//	mx                     deliver to the domain's MX hosts
+//	relay:host[:port],...  deliver via fixed relay host(s)
+//	lmtp:host[:port]       deliver via LMTP over TCP
+//	lmtp:unix:/path        deliver via LMTP over a Unix socket
+//	maildir:/path          deliver into Maildir folders under /path
+//	pipe:command [args]    feed the message to an external command
+func parseTransport(spec string) (transport, error) {
+	p := strings.SplitN(spec, ":", 2)
+	kind := strings.ToLower(strings.TrimSpace(p[0]))
+	arg := ""
+	if len(p) > 1 {
+		arg = strings.TrimSpace(p[1])
+	}
+	switch kind {
+	case "mx":
+		return mxTransport{}, nil
+	case "relay":
+		var hosts relayTransport
+		for _, h := range strings.Split(arg, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hosts = append(hosts, h)
+			}
+		}
+		if len(hosts) > 0 {
+			return hosts, nil
+		}
+		return nil, fmt.Errorf("transport %q: missing relay host", spec)
+	case "maildir":
+		if arg == "" {
+			return nil, fmt.Errorf("transport %q: missing Maildir root", spec)
+		}
+		return maildirTransport(path.Clean(arg)), nil
+	case "lmtp":
+		if arg == "" || arg == "unix:" {
+			return nil, fmt.Errorf("transport %q: missing LMTP server", spec)
+		}
+		return lmtpTransport(arg), nil
+	case "pipe":
+		argv := strings.Fields(arg)
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("transport %q: missing command", spec)
+		}
+		return pipeTransport(argv), nil
+	}
+	return nil, fmt.Errorf("transport %q: unknown type", spec)
+}
+
+// compileTransports builds the transport table.  Patterns are exact domains
+// ("example.com"), subdomain wildcards (".example.com" or "*.example.com",
+// which do not match example.com itself) or "*" as the default.  Gateways
+// are the default too, so setting both is an error.
+func (s *Settings) compileTransports() error {
+	for pattern, spec := range s.Transports {
+		t, err := parseTransport(spec)
+		if err != nil {
+			return err
+		}
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasPrefix(pattern, "*.") {
+			pattern = pattern[1:]
+		}
+		s.transports[pattern] = t
+	}
+	if _, ok := s.transports["*"]; ok && len(s.Gateways) > 0 {
+		return fmt.Errorf("transport \"*\" conflicts with Gateways, use one of them")
+	}
+	return nil
+}
+
+func (s *Settings) transportFor(domain string) transport {
+	domain = strings.ToLower(domain)
+	if t, ok := s.transports[domain]; ok {
+		return t
+	}
+	for d := domain; ; {
+		dot := strings.Index(d, ".")
+		if dot < 0 {
+			break
+		}
+		d = d[dot+1:]
+		if t, ok := s.transports["."+d]; ok {
+			return t
+		}
+	}
+	if len(s.Gateways) > 0 {
+		return relayTransport(s.Gateways)
+	}
+	if t, ok := s.transports["*"]; ok {
+		return t
+	}
+	return mxTransport{}
+}
@@ -1,8 +1,11 @@
 package smtp
 
 import (
-	"os"
+	"bufio"
 	"io"
+	"net"
+	"os"
+	"strings"
 )
 
 func CopyFile(src, dst string) (written int64, err error) {
@@ -16,7 +19,7 @@ func CopyFile(src, dst string) (written int64, err error) {
 		return
 	}
 	defer dstFile.Close()
-	return io.Copy(srcFile, dstFile)
+	return io.Copy(dstFile, srcFile)
 }
 
 func MoveFile(src, dst string) (err error) {
@@ -30,3 +33,88 @@ func MoveFile(src, dst string) (err error) {
 	}
 	return os.Remove(src)
 }
+
+// writeData copies a spooled message to w as SMTP DATA content, i.e. with
+// leading dots doubled (RFC5321, 4.5.2) and ending with a line break.  The
+// terminating "." is not written.
+func writeData(w io.Writer, msg io.Reader) (written int64, err error) {
+	br := bufio.NewReader(msg)
+	bw := bufio.NewWriter(w)
+	eol := true
+	for {
+		line, rerr := br.ReadSlice('\n')
+		if len(line) > 0 {
+			if eol && line[0] == '.' {
+				bw.WriteByte('.')
+				written++
+			}
+			n, _ := bw.Write(line)
+			written += int64(n)
+			eol = line[len(line)-1] == '\n'
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil && rerr != bufio.ErrBufferFull {
+			return written, rerr
+		}
+	}
+	if !eol {
+		bw.WriteString("\r\n")
+	}
+	return written, bw.Flush()
+}
+
+// writeUnix copies a spooled message to w with line endings converted from
+// CRLF to LF, for consumers such as Maildir and pipe commands.
+func writeUnix(w io.Writer, msg io.Reader) (written int64, err error) {
+	br := bufio.NewReader(msg)
+	bw := bufio.NewWriter(w)
+	cr := false
+	for {
+		b, rerr := br.ReadByte()
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+		if cr && b != '\n' {
+			bw.WriteByte('\r')
+			written++
+		}
+		cr = b == '\r'
+		if !cr {
+			bw.WriteByte(b)
+			written++
+		}
+	}
+	if cr {
+		bw.WriteByte('\n')
+		written++
+	}
+	return written, bw.Flush()
+}
+
+// addrLiteral formats ip as an SMTP address literal (RFC5321, 4.1.3), e.g.
+// "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func addrLiteral(ip net.IP) string {
+	if ip == nil {
+		return "[127.0.0.1]"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return "[" + ip4.String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// printable drops control and non-ASCII characters from s, text from DNS
+// that goes into headers or replies.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+}